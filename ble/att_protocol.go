@@ -1,8 +1,10 @@
 package ble
 
 import (
+  "bytes"
   "errors"
   "fmt"
+  "time"
 )
 
 const (
@@ -40,22 +42,116 @@ const (
   ATT_OPCODE_CONN_UPDATE = 0xF0
 )
 
+const (
+  // Default ATT MTU for LE links before an MTU exchange
+  ATT_DEFAULT_MTU uint16 = 23
+  // Largest MTU Beetle will negotiate: a 512 byte attribute value plus the
+  // largest PDU header
+  ATT_MAX_MTU uint16 = 517
+)
+
 type AttPDU interface {
   Msg()    []byte
 }
 
+// A 16-bit Bluetooth SIG assigned UUID keeps its value, least significant
+// octet first, in octets 2-3, followed by the big-endian Bluetooth base UUID.
+// Any other UUID holds its 16 octets in ATT (little-endian) order.
 type UUID [16]uint8
 
 var BLUETOOTH_BASE_UUID [12]byte =
   [12]byte{0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
 var GATT_PRIMARY_SERVICE_UUID UUID =
   [16]byte{0, 0, 0x0, 0x28, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
+var GATT_SECONDARY_SERVICE_UUID UUID =
+  [16]byte{0, 0, 0x1, 0x28, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
+var GATT_INCLUDE_UUID UUID =
+  [16]byte{0, 0, 0x2, 0x28, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
 var GATT_CHARACTERISTIC_UUID UUID =
   [16]byte{0, 0, 0x3, 0x28, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
 
 var GATT_CLIENT_CONFIGURATION_UUID UUID =
   [16]byte{0, 0, 0x2, 0x29, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
 
+var GATT_SERVICE_CHANGED_UUID UUID =
+  [16]byte{0, 0, 0x05, 0x2A, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
+var GATT_DATABASE_HASH_UUID UUID =
+  [16]byte{0, 0, 0x2A, 0x2B, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
+
+// Returns the 128-bit form of a 16-bit Bluetooth SIG assigned UUID.
+func UUID16(id uint16) UUID {
+  var uuid UUID
+  uuid[2] = byte(id & 0xff)
+  uuid[3] = byte(id >> 8)
+  for j := 4; j < 16; j++ {
+    uuid[j] = BLUETOOTH_BASE_UUID[j - 4]
+  }
+  return uuid
+}
+
+// Whether the UUID is a 16-bit Bluetooth SIG assigned UUID, which ATT sends
+// in its 2 octet short form.
+func (this UUID) Is16Bit() bool {
+  if this[0] != 0 || this[1] != 0 {
+    return false
+  }
+  for j := 4; j < 16; j++ {
+    if this[j] != BLUETOOTH_BASE_UUID[j - 4] {
+      return false
+    }
+  }
+  return true
+}
+
+// Returns the UUID as ATT sends it: 2 octets for 16-bit UUIDs and 16
+// octets otherwise, least significant octet first.
+func (this UUID) Bytes() []byte {
+  if this.Is16Bit() {
+    return []byte{this[2], this[3]}
+  }
+  result := make([]byte, 16)
+  copy(result, this[:])
+  return result
+}
+
+// Returns the 128-bit ATT encoding of the UUID, even for 16-bit UUIDs.
+func (this UUID) LongBytes() []byte {
+  if !this.Is16Bit() {
+    return this.Bytes()
+  }
+  result := make([]byte, 16)
+  for j := 0; j < 12; j++ {
+    result[j] = BLUETOOTH_BASE_UUID[11 - j]
+  }
+  result[12] = this[2]
+  result[13] = this[3]
+  return result
+}
+
+// Decodes a UUID sent by ATT in either its 2 or 16 octet form. 128-bit forms
+// of 16-bit UUIDs decode to the same value as their short forms. Returns the
+// zero UUID for any other length.
+func DecodeUUID(b []byte) UUID {
+  var uuid UUID
+  switch len(b) {
+  case 2:
+    return UUID16(uint16(b[0]) | uint16(b[1]) << 8)
+  case 16:
+    copy(uuid[:], b)
+    short := UUID16(uint16(b[12]) | uint16(b[13]) << 8)
+    if bytes.Equal(b, short.LongBytes()) {
+      return short
+    }
+  }
+  return uuid
+}
+
+// Client characteristic configuration bits
+const (
+  GATT_CCCD_NOTIFY   uint16 = 0x0001
+  GATT_CCCD_INDICATE uint16 = 0x0002
+)
+
 type HandleInfo struct {
   format uint8
   handle uint16
@@ -144,13 +240,22 @@ type FindInfoResponse struct {
   msg []byte
 }
 
-func NewFindInfoResponse(handles []HandleUUID) (*FindInfoResponse) {
-  msg := make([]byte, 24)
+// Builds a Find Information response. A response holds only 16-bit or only
+// 128-bit UUIDs, so it stops at the first handle whose UUID is of the other
+// kind; the client finds the rest with another request.
+func NewFindInfoResponse(handles []HandleUUID, mtu uint16) (*FindInfoResponse) {
+  msg := make([]byte, mtu)
   msg[0] = ATT_OPCODE_FIND_INFO_RESPONSE
-  msg[1] = 1
+  short := handles[0].uuid.Is16Bit()
+  if short {
+    msg[1] = 1
+  } else {
+    msg[1] = 2
+  }
+  step := findInfoStep(msg[1])
   i := 2
   for _, handle := range handles {
-    if i > len(msg) - 4 {
+    if handle.uuid.Is16Bit() != short || i + step > len(msg) {
       break
     }
 
@@ -158,21 +263,36 @@ func NewFindInfoResponse(handles []HandleUUID) (*FindInfoResponse) {
     i++
     msg[i] = byte(handle.handle >> 8)
     i++
-    msg[i] = handle.uuid[2]
-    i++
-    msg[i] = handle.uuid[3]
-    i++
+    i += copy(msg[i:], handle.uuid.Bytes())
   }
 
   return &FindInfoResponse{msg[0:i]}
 }
 
+// Returns the length of each entry in a Find Information response of the
+// given format, or 0 if the format is unknown.
+func findInfoStep(format uint8) int {
+  switch format {
+  case 1:
+    return 4
+  case 2:
+    return 18
+  }
+  return 0
+}
+
 func ParseFindInfoResponse(msg []byte) (*FindInfoResponse, error) {
-  if len(msg) >= 6 {
-    return &FindInfoResponse{msg}, nil
-  } else {
+  if len(msg) < 2 {
     return nil, errors.New("Message is not the right length")
   }
+  step := findInfoStep(msg[1])
+  if step == 0 {
+    return nil, errors.New("Unknown Find Information format")
+  }
+  if len(msg) < 2 + step || (len(msg) - 2) % step != 0 {
+    return nil, errors.New("Message is not the right length")
+  }
+  return &FindInfoResponse{msg}, nil
 }
 
 func (this *FindInfoResponse) Msg() []byte {
@@ -185,31 +305,14 @@ func (this *FindInfoResponse) Format() uint8 {
 
 func (this *FindInfoResponse) InfoData() []*HandleInfo {
   format := this.Format()
-  var step int
-  if format == 1 {
-    step = 4
-  } else {
-    step = 18
-  }
+  step := findInfoStep(format)
 
   ihs := make([]*HandleInfo, 0)
   for i := 2; i < len(this.msg); i += step {
     buf := this.msg[i:i + step]
 
-    handleNum := uint16(buf[0]) + uint16(buf[1]) << 16
-    var uuid UUID
-    if format == 2 {
-      for j := 0; j < 16; j++ {
-        uuid[j] = buf[j]
-      }
-    } else {
-      uuid[2] = buf[2]
-      uuid[3] = buf[3]
-
-      for j := 4; j < 16; j++ {
-        uuid[j] = BLUETOOTH_BASE_UUID[j - 4]
-      }
-    }
+    handleNum := uint16(buf[0]) + uint16(buf[1]) << 8
+    uuid := DecodeUUID(buf[2:])
 
     handle := &HandleInfo{}
     handle.format = format
@@ -241,14 +344,170 @@ type ReadByGroupTypeResponse struct {
   msg []byte
 }
 
+// Checks that the attribute data list of a Read By Type or Read By Group Type
+// response holds one or more whole entries of at least `min` octets each.
+func checkDataList(msg []byte, min int) error {
+  if len(msg) < 2 {
+    return errors.New("Message is not the right length")
+  }
+  step := int(msg[1])
+  if step < min || len(msg) < 2 + step || (len(msg) - 2) % step != 0 {
+    return errors.New("Malformed attribute data list")
+  }
+  return nil
+}
+
 func ParseReadByGroupTypeResponse(msg []byte) (*ReadByGroupTypeResponse, error) {
-  if len(msg) >= 4 {
-    return &ReadByGroupTypeResponse{msg}, nil
+  if err := checkDataList(msg, 4); err != nil {
+    return nil, err
+  }
+  return &ReadByGroupTypeResponse{msg}, nil
+}
+
+func (this *ReadByGroupTypeResponse) Msg() []byte {
+  return this.msg
+}
+
+func NewReadByGroupTypeResponse(vals []*GroupValue, mtu uint16) (*ReadByGroupTypeResponse) {
+  msg := make([]byte, mtu)
+  msg[0] = ATT_OPCODE_READ_BY_GROUP_TYPE_RESPONSE
+
+  // Values too long for a single entry are truncated
+  valLen := len(vals[0].value)
+  baseLen := valLen
+  if baseLen > int(mtu) - 6 {
+    baseLen = int(mtu) - 6
+  }
+  if baseLen > 251 {
+    baseLen = 251
+  }
+  msg[1] = byte(baseLen) + 4
+  i := 2
+  for _, val := range vals {
+    if len(val.value) != valLen {
+      break
+    }
+    if i + 4 + baseLen > len(msg) {
+      break
+    }
+    msg[i] = byte(val.handle & 0xff)
+    i++
+    msg[i] = byte(val.handle >> 8)
+    i++
+    msg[i] = byte(val.endGroup & 0xff)
+    i++
+    msg[i] = byte(val.endGroup >> 8)
+    i++
+    copy(msg[i:], val.value[:baseLen])
+    i += baseLen
+  }
+
+  return &ReadByGroupTypeResponse{msg[0:i]}
+}
+
+type ReadMultipleRequest struct {
+  msg []byte
+}
+
+func NewReadMultipleRequest(handles []uint16) (*ReadMultipleRequest) {
+  msg := make([]byte, 1 + 2 * len(handles))
+  msg[0] = ATT_OPCODE_READ_MULTIPLE_REQUEST
+  for i, handle := range handles {
+    msg[1 + 2 * i] = byte(handle & 0xff)
+    msg[2 + 2 * i] = byte(handle >> 8)
+  }
+  return &ReadMultipleRequest{msg}
+}
+
+func ParseReadMultipleRequest(msg []byte) (*ReadMultipleRequest, error) {
+  if len(msg) >= 5 && len(msg) % 2 == 1 {
+    return &ReadMultipleRequest{msg}, nil
+  } else {
+    return nil, errors.New("Message is not the right length")
+  }
+}
+
+func (this *ReadMultipleRequest) Msg() []byte {
+  return this.msg
+}
+
+func (this *ReadMultipleRequest) Handles() []uint16 {
+  handles := make([]uint16, 0, len(this.msg) / 2)
+  for i := 1; i < len(this.msg); i += 2 {
+    handles = append(handles, uint16(this.msg[i]) | uint16(this.msg[i + 1]) << 8)
+  }
+  return handles
+}
+
+type PrepareWriteRequest struct {
+  msg []byte
+}
+
+func ParsePrepareWriteRequest(msg []byte) (*PrepareWriteRequest, error) {
+  if len(msg) >= 5 {
+    return &PrepareWriteRequest{msg}, nil
   } else {
     return nil, errors.New("Message is not the right length")
   }
 }
 
+func (this *PrepareWriteRequest) Handle() uint16 {
+  return uint16(this.msg[1]) | uint16(this.msg[2]) << 8
+}
+
+func (this *PrepareWriteRequest) Offset() uint16 {
+  return uint16(this.msg[3]) | uint16(this.msg[4]) << 8
+}
+
+func (this *PrepareWriteRequest) Value() []byte {
+  return this.msg[5:]
+}
+
+const (
+  ATT_EXECUTE_WRITE_CANCEL uint8 = 0x00
+  ATT_EXECUTE_WRITE_COMMIT uint8 = 0x01
+)
+
+type ExecuteWriteRequest struct {
+  msg []byte
+}
+
+func NewExecuteWriteRequest(flags uint8) (*ExecuteWriteRequest) {
+  return &ExecuteWriteRequest{[]byte{ATT_OPCODE_EXECUTE_WRITE_REQUEST, flags}}
+}
+
+func ParseExecuteWriteRequest(msg []byte) (*ExecuteWriteRequest, error) {
+  if len(msg) == 2 {
+    return &ExecuteWriteRequest{msg}, nil
+  } else {
+    return nil, errors.New("Message must be 2 octets")
+  }
+}
+
+func (this *ExecuteWriteRequest) Flags() uint8 {
+  return this.msg[1]
+}
+
+func ParseReadByGroupTypeRequest(msg []byte) (*ReadByGroupTypeRequest, error) {
+  if len(msg) == 7 || len(msg) == 21 {
+    return &ReadByGroupTypeRequest{msg}, nil
+  } else {
+    return nil, errors.New("Message is not the right length")
+  }
+}
+
+func (this *ReadByGroupTypeRequest) StartHandle() uint16 {
+  return uint16(this.msg[1]) | uint16(this.msg[2]) << 8
+}
+
+func (this *ReadByGroupTypeRequest) EndHandle() uint16 {
+  return uint16(this.msg[3]) | uint16(this.msg[4]) << 8
+}
+
+func (this *ReadByGroupTypeRequest) Type() UUID {
+  return DecodeUUID(this.msg[5:])
+}
+
 type FindByTypeValueRequest struct {
   msg []byte
 }
@@ -269,15 +528,10 @@ func (this *FindByTypeValueRequest) EndHandle() uint16 {
   return uint16(this.msg[3]) | uint16(this.msg[4]) << 8
 }
 
+// The attribute type of a Find By Type Value request is always 16-bit. The
+// value, e.g. a service UUID, may be either length.
 func (this *FindByTypeValueRequest) Type() UUID {
-  var uuid UUID
-  uuid[2] = this.msg[5]
-  uuid[3] = this.msg[6]
-
-  for j := 4; j < 16; j++ {
-    uuid[j] = BLUETOOTH_BASE_UUID[j - 4]
-  }
-  return uuid
+  return DecodeUUID(this.msg[5:7])
 }
 
 func (this *FindByTypeValueRequest) Value() []byte {
@@ -288,14 +542,14 @@ type FindByTypeValueResponse struct {
   msg []byte
 }
 
-func NewFindByTypeValueResponse(vals []*GroupValue) (*FindByTypeValueResponse) {
-  msg := make([]byte, 24)
+func NewFindByTypeValueResponse(vals []*GroupValue, mtu uint16) (*FindByTypeValueResponse) {
+  msg := make([]byte, mtu)
   msg[0] = ATT_OPCODE_FIND_BY_TYPE_VALUE_RESPONSE
 
   i := 1
   cutShort := false
   for _, val := range vals {
-    if i > 20 {
+    if i + 4 > len(msg) {
       cutShort = true
       break
     }
@@ -322,17 +576,29 @@ type ReadByTypeRequest struct {
 }
 
 func NewReadByTypeRequest(startHandle, endHandle uint16, attType UUID) (*ReadByTypeRequest){
-  msg := make([]byte, 7)
+  msg := make([]byte, 5)
   msg[0] = ATT_OPCODE_READ_BY_TYPE_REQUEST
   msg[1] = byte(startHandle & 0xff)
   msg[2] = byte(startHandle >> 8)
   msg[3] = byte(endHandle & 0xff)
   msg[4] = byte(endHandle >> 8)
-  msg[5] = attType[2]
-  msg[6] = attType[3]
+  msg = append(msg, attType.Bytes()...)
   return &ReadByTypeRequest{msg}
 }
 
+type ReadByGroupTypeRequest struct {
+  msg []byte
+}
+
+func NewReadByGroupTypeRequest(startHandle, endHandle uint16,
+                               groupType UUID) (*ReadByGroupTypeRequest) {
+  msg := []byte{ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST,
+    byte(startHandle & 0xff), byte(startHandle >> 8),
+    byte(endHandle & 0xff), byte(endHandle >> 8)}
+  msg = append(msg, groupType.Bytes()...)
+  return &ReadByGroupTypeRequest{msg}
+}
+
 func ParseReadByTypeRequest(msg []byte) (*ReadByTypeRequest, error) {
   if len(msg) == 7 || len(msg) == 21 {
     return &ReadByTypeRequest{msg}, nil
@@ -350,57 +616,51 @@ func (this *ReadByTypeRequest) EndHandle() uint16 {
 }
 
 func (this *ReadByTypeRequest) Type() UUID {
-  var uuid UUID
-  if len(this.msg) == 7 {
-    uuid[2] = this.msg[5]
-    uuid[3] = this.msg[6]
-
-    for j := 4; j < 16; j++ {
-      uuid[j] = BLUETOOTH_BASE_UUID[j - 4]
-    }
-  } else {
-    for i := 0; i < 16; i++ {
-      uuid[i] = this.msg[5 + i]
-    }
-  }
-  return uuid
+  return DecodeUUID(this.msg[5:])
 }
 
 type ReadByTypeResponse struct {
   msg []byte
 }
 
-func NewReadByTypeResponse(vals []*GroupValue) (*ReadByTypeResponse) {
-  msg := make([]byte, 24)
+func NewReadByTypeResponse(vals []*GroupValue, mtu uint16) (*ReadByTypeResponse) {
+  msg := make([]byte, mtu)
   msg[0] = ATT_OPCODE_READ_BY_TYPE_RESPONSE
 
-  baseLen := len(vals[0].value)
+  // Values too long for a single entry are truncated
+  valLen := len(vals[0].value)
+  baseLen := valLen
+  if baseLen > int(mtu) - 4 {
+    baseLen = int(mtu) - 4
+  }
+  if baseLen > 253 {
+    baseLen = 253
+  }
   msg[1] = byte(baseLen) + 2
   i := 2
   for _, val := range vals {
-    if len(val.value) != baseLen {
+    if len(val.value) != valLen {
       break
     }
-    if i > len(msg) - 2 - len(val.value) {
+    if i + 2 + baseLen > len(msg) {
       break
     }
     msg[i] = byte(val.handle & 0xff)
     i++
     msg[i] = byte(val.handle >> 8)
     i++
-    copy(msg[i:], val.value)
-    i += len(val.value)
+    copy(msg[i:], val.value[:baseLen])
+    i += baseLen
   }
 
   return &ReadByTypeResponse{msg[0:i]}
 }
 
 func ParseReadByTypeResponse(msg []byte) (*ReadByTypeResponse, error) {
-  if len(msg) >= 4 {
-    return &ReadByTypeResponse{msg}, nil
-  } else {
-    return nil, errors.New("Message is not the right length")
+  if err := checkDataList(msg, 2); err != nil {
+    return nil, err
   }
+  return &ReadByTypeResponse{msg}, nil
 }
 
 
@@ -437,8 +697,8 @@ func (this *ReadByGroupTypeResponse) DataList() []*GroupValue {
   for i := 2; i < len(this.msg); i += step {
     buf := this.msg[i:i + step]
 
-    handle := uint16(buf[0]) + uint16(buf[1]) << 16
-    endGroup := uint16(buf[2]) + uint16(buf[3]) << 16
+    handle := uint16(buf[0]) + uint16(buf[1]) << 8
+    endGroup := uint16(buf[2]) + uint16(buf[3]) << 8
     value := make([]byte, length)
     copy(value, buf[4:])
 
@@ -469,7 +729,7 @@ func (this *ReadByTypeResponse) DataList() []*HandleValue {
   for i := 2; i < len(this.msg); i += step {
     buf := this.msg[i:i + step]
 
-    handle := uint16(buf[0]) + uint16(buf[1]) << 16
+    handle := uint16(buf[0]) + uint16(buf[1]) << 8
     value := make([]byte, length)
     copy(value, buf[2:])
 
@@ -482,24 +742,240 @@ func (this *ReadByTypeResponse) DataList() []*HandleValue {
   return vals
 }
 
-func DiscoverServices(f *Device) ([]*GroupValue, error) {
+// A request or command addressing a single attribute: Read, Read Blob, Write
+// and Signed Write
+type HandleRequest struct {
+  msg []byte
+}
+
+func ParseHandleRequest(msg []byte) (*HandleRequest, error) {
+  if len(msg) < 3 {
+    return nil, errors.New("Message is not the right length")
+  }
+  switch msg[0] {
+  case ATT_OPCODE_READ_REQUEST:
+    if len(msg) != 3 {
+      return nil, errors.New("Message must be 3 octets")
+    }
+  case ATT_OPCODE_READ_BLOB_REQUEST:
+    if len(msg) != 5 {
+      return nil, errors.New("Message must be 5 octets")
+    }
+  case ATT_OPCODE_SIGNED_WRITE_COMMAND:
+    // Followed by a 12 octet signature
+    if len(msg) < 15 {
+      return nil, errors.New("Message is not the right length")
+    }
+  }
+  return &HandleRequest{msg}, nil
+}
+
+func (this *HandleRequest) Opcode() uint8 {
+  return this.msg[0]
+}
+
+func (this *HandleRequest) Handle() uint16 {
+  return uint16(this.msg[1]) | uint16(this.msg[2]) << 8
+}
+
+// Offset of a Read Blob request
+func (this *HandleRequest) Offset() uint16 {
+  if this.msg[0] != ATT_OPCODE_READ_BLOB_REQUEST {
+    return 0
+  }
+  return uint16(this.msg[3]) | uint16(this.msg[4]) << 8
+}
+
+// Value of a write, including the signature of a Signed Write
+func (this *HandleRequest) Value() []byte {
+  return this.msg[3:]
+}
+
+// A Handle Value Notification or Indication
+type HandleValueUpdate struct {
+  msg []byte
+}
+
+func ParseHandleValueUpdate(msg []byte) (*HandleValueUpdate, error) {
+  if len(msg) < 3 {
+    return nil, errors.New("Message is not the right length")
+  }
+  return &HandleValueUpdate{msg}, nil
+}
+
+func (this *HandleValueUpdate) Handle() uint16 {
+  return uint16(this.msg[1]) | uint16(this.msg[2]) << 8
+}
+
+func (this *HandleValueUpdate) Value() []byte {
+  return this.msg[3:]
+}
+
+type MTURequest struct {
+  msg []byte
+}
+
+func NewMTURequest(mtu uint16) (*MTURequest) {
+  return &MTURequest{[]byte{ATT_OPCODE_MTU_REQUEST,
+                            byte(mtu & 0xff), byte(mtu >> 8)}}
+}
+
+func ParseMTURequest(msg []byte) (*MTURequest, error) {
+  if len(msg) != 3 {
+    return nil, errors.New("Message must be 3 octets")
+  }
+
+  return &MTURequest{msg}, nil
+}
+
+func (this *MTURequest) MTU() uint16 {
+  return uint16(this.msg[1]) | uint16(this.msg[2]) << 8
+}
+
+func (this *MTURequest) Msg() []byte {
+  return this.msg
+}
+
+type MTUResponse struct {
+  msg []byte
+}
+
+func NewMTUResponse(mtu uint16) (*MTUResponse) {
+  return &MTUResponse{[]byte{ATT_OPCODE_MTU_RESPONSE,
+                             byte(mtu & 0xff), byte(mtu >> 8)}}
+}
+
+func (this *MTUResponse) Msg() []byte {
+  return this.msg
+}
+
+// Returns the MTU to use on a link given the MTU advertised by the remote side,
+// never smaller than the default or larger than what Beetle supports.
+func NegotiateMTU(remoteMTU uint16) uint16 {
+  if remoteMTU < ATT_DEFAULT_MTU {
+    return ATT_DEFAULT_MTU
+  } else if remoteMTU > ATT_MAX_MTU {
+    return ATT_MAX_MTU
+  }
+  return remoteMTU
+}
+
+// Truncates a response forwarded from a peripheral so it fits within `mtu`.
+// Read responses lose the tail of the value (which the client can fetch with
+// Read Blob) and list responses drop whole entries that don't fit, keeping the
+// first entry with its value truncated if it doesn't fit alone.
+func FitToMTU(msg []byte, mtu uint16) []byte {
+  if len(msg) <= int(mtu) {
+    return msg
+  }
+
+  step := 0
+  switch msg[0] {
+  case ATT_OPCODE_READ_BY_TYPE_RESPONSE, ATT_OPCODE_READ_BY_GROUP_TYPE_RESPONSE:
+    step = int(msg[1])
+  case ATT_OPCODE_FIND_INFO_RESPONSE:
+    if msg[1] == 1 {
+      step = 4
+    } else {
+      step = 18
+    }
+  case ATT_OPCODE_FIND_BY_TYPE_VALUE_RESPONSE:
+    return msg[:1 + (int(mtu) - 1) / 4 * 4]
+  }
+
+  if step == 0 {
+    return msg[:mtu]
+  } else if step > int(mtu) - 2 {
+    result := make([]byte, mtu)
+    copy(result, msg)
+    result[1] = byte(mtu - 2)
+    return result
+  }
+  return msg[:2 + (int(mtu) - 2) / step * step]
+}
+
+// Exchanges MTUs with a peripheral, returning the MTU to use on the link.
+// Peripherals that don't support the exchange use the default MTU.
+func ExchangeMTU(f *Device, mtu uint16) (uint16, error) {
+  respS := f.transact(NewMTURequest(mtu).msg,
+    time.Now().Add(ATT_TRANSACTION_TIMEOUT))
+  err := respS.err
+  resp := respS.value
+
+  if err != nil {
+    return 0, err
+  }
+
+  if resp[0] == ATT_OPCODE_MTU_RESPONSE && len(resp) == 3 {
+    remoteMTU := uint16(resp[1]) | uint16(resp[2]) << 8
+    if remoteMTU < mtu {
+      mtu = remoteMTU
+    }
+    return NegotiateMTU(mtu), nil
+  } else if resp[0] == ATT_OPCODE_ERROR {
+    return ATT_DEFAULT_MTU, nil
+  } else {
+    str := fmt.Sprintf("%v", resp)
+    return 0, errors.New("Unexpected packet: " + str)
+  }
+}
+
+// Reads the peripheral's Database Hash characteristic. Returns nil if the
+// peripheral doesn't expose one.
+func ReadDatabaseHash(f *Device) ([]byte, error) {
+  req := NewReadByTypeRequest(1, 0xffff, GATT_DATABASE_HASH_UUID)
+  respS := f.transact(req.msg, time.Now().Add(ATT_TRANSACTION_TIMEOUT))
+  err := respS.err
+  resp := respS.value
+
+  if err != nil {
+    return nil, err
+  }
+
+  if resp[0] == ATT_OPCODE_READ_BY_TYPE_RESPONSE {
+    fi, err := ParseReadByTypeResponse(resp)
+    if err != nil {
+      return nil, err
+    }
+    vals := fi.DataList()
+    if len(vals) == 0 {
+      return nil, nil
+    }
+    return vals[0].value, nil
+  } else if resp[0] == ATT_OPCODE_ERROR {
+    // Attribute Not Found or not readable without authentication
+    return nil, nil
+  } else {
+    str := fmt.Sprintf("%v", resp)
+    return nil, errors.New("Unexpected packet: " + str)
+  }
+}
+
+// Whether `resp` is an Attribute Not Found error for `reqOpcode`, which ends a
+// discovery procedure.
+func isNotFound(resp []byte, reqOpcode uint8) bool {
+  e, err := ParseError(resp)
+  return err == nil && e.ReqOpcode() == reqOpcode && e.ErrorCode() == 0x0A
+}
+
+// Whether `resp` rejects `reqOpcode` with Request Not Supported or Unsupported
+// Group Type.
+func isUnsupported(resp []byte, reqOpcode uint8) bool {
+  e, err := ParseError(resp)
+  return err == nil && e.ReqOpcode() == reqOpcode &&
+    (e.ErrorCode() == 0x06 || e.ErrorCode() == 0x10)
+}
+
+func DiscoverServices(f *Device, serviceType UUID) ([]*GroupValue, error) {
   var startHandle uint16 = 1
   var endHandle uint16   = 0xffff
 
   vals := make([]*GroupValue, 0, 4)
   for {
-    buf := make([]byte, 7)
-    // populate packet buffer
-    buf[0] = ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST
-    buf[1] = byte(startHandle & 0xff)
-    buf[2] = byte(startHandle >> 8)
-    buf[3] = byte(endHandle & 0xff)
-    buf[4] = byte(endHandle >> 8)
-    copy(buf[5:], []byte{0, 0x28}) // Primary Service UUID
+    // Primary or Secondary Service UUID
+    buf := NewReadByGroupTypeRequest(startHandle, endHandle, serviceType).msg
 
-    r := make(chan Response)
-    f.transactChan<-Transaction{buf, r}
-    respS := <-r
+    respS := f.transact(buf, time.Now().Add(ATT_TRANSACTION_TIMEOUT))
     err := respS.err
     resp := respS.value
 
@@ -514,13 +990,24 @@ func DiscoverServices(f *Device) ([]*GroupValue, error) {
       }
       vals = append(vals, fi.DataList()...)
 
-      startHandle = vals[len(vals) - 1].endGroup + 1
+      last := vals[len(vals) - 1]
+      if last.endGroup == 0xffff {
+        break
+      }
+      if last.handle < startHandle || last.endGroup < last.handle {
+        return nil, errors.New("Service groups out of order")
+      }
+      startHandle = last.endGroup + 1
       continue
     }
 
-    if resp[0] == ATT_OPCODE_ERROR  &&
-       resp[1] == ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST && resp[4] == 0x0A {
+    if isNotFound(resp, ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST) {
         break
+    } else if serviceType == GATT_SECONDARY_SERVICE_UUID &&
+              isUnsupported(resp, ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST) {
+      // Some peripherals don't accept secondary services as a grouping type,
+      // which means they have none
+      break
     } else {
       str := fmt.Sprintf("%v", resp)
       return nil, errors.New("Unexpected packet: " + str)
@@ -544,9 +1031,7 @@ func DiscoverCharacteristics(f *Device, startHandle uint16,
     buf[4] = byte(endHandle >> 8)
     copy(buf[5:], []byte{3, 0x28}) // Characteristic Decleration
 
-    r := make(chan Response)
-    f.transactChan<-Transaction{buf, r}
-    respS := <-r
+    respS := f.transact(buf, time.Now().Add(ATT_TRANSACTION_TIMEOUT))
     err := respS.err
     resp := respS.value
 
@@ -559,14 +1044,27 @@ func DiscoverCharacteristics(f *Device, startHandle uint16,
       if err != nil {
         return nil, err
       }
-      vals = append(vals, fi.DataList()...)
+      found := fi.DataList()
+      for _, val := range found {
+        // Properties followed by the value handle and UUID
+        if len(val.value) < 3 {
+          return nil, errors.New("Characteristic declaration too short")
+        }
+      }
+      vals = append(vals, found...)
 
-      startHandle = vals[len(vals) - 1].handle + 1
+      last := vals[len(vals) - 1].handle
+      if last < startHandle {
+        return nil, errors.New("Characteristics out of order")
+      }
+      if last >= endHandle {
+        break
+      }
+      startHandle = last + 1
       continue
     }
 
-    if resp[0] == ATT_OPCODE_ERROR  &&
-       resp[1] == ATT_OPCODE_READ_BY_TYPE_REQUEST && resp[4] == 0x0A {
+    if isNotFound(resp, ATT_OPCODE_READ_BY_TYPE_REQUEST) {
         break
     } else {
       str := fmt.Sprintf("%v", resp)
@@ -589,9 +1087,7 @@ func DiscoverHandles(f *Device, startHandle uint16,
     buf[3] = byte(endHandle & 0xff)
     buf[4] = byte(endHandle >> 8)
 
-    r := make(chan Response)
-    f.transactChan<-Transaction{buf, r}
-    respS := <-r
+    respS := f.transact(buf, time.Now().Add(ATT_TRANSACTION_TIMEOUT))
     err := respS.err
     resp := respS.value
 
@@ -606,16 +1102,18 @@ func DiscoverHandles(f *Device, startHandle uint16,
       }
       handles = append(handles, fi.InfoData()...)
 
-      startHandle = handles[len(handles) - 1].handle + 1
-      if startHandle >= endHandle {
+      last := handles[len(handles) - 1].handle
+      if last < startHandle {
+        return nil, errors.New("Handles out of order")
+      }
+      if last >= endHandle {
         break
-      } else {
-        continue
       }
+      startHandle = last + 1
+      continue
     }
 
-    if resp[0] == ATT_OPCODE_ERROR  &&
-       resp[1] == ATT_OPCODE_FIND_INFO_REQUEST && resp[4] == 0x0A {
+    if isNotFound(resp, ATT_OPCODE_FIND_INFO_REQUEST) {
         break
     } else {
       return nil, errors.New("Unexpected packet: " + string(resp))
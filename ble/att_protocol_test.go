@@ -0,0 +1,322 @@
+package ble
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestNewReadByTypeResponse(t *testing.T) {
+  value := make([]byte, 300)
+  msg := NewReadByTypeResponse([]*GroupValue{{3, 0, value}, {5, 0, value}},
+    ATT_MAX_MTU).msg
+  // Values are truncated to fit the length byte
+  if len(msg) != 2 + 2 * 255 || msg[1] != 255 {
+    t.Fatalf("length %d, entries of %d", len(msg), msg[1])
+  }
+}
+
+func FuzzParseFindInfoResponse(f *testing.F) {
+  f.Add([]byte{ATT_OPCODE_FIND_INFO_RESPONSE, 1, 1, 0, 0x00, 0x28})
+  f.Add(append([]byte{ATT_OPCODE_FIND_INFO_RESPONSE, 2, 1, 0},
+    make([]byte, 16)...))
+  f.Add([]byte{ATT_OPCODE_FIND_INFO_RESPONSE, 3, 1, 0})
+  f.Fuzz(func(t *testing.T, msg []byte) {
+    resp, err := ParseFindInfoResponse(msg)
+    if err != nil {
+      return
+    }
+    info := resp.InfoData()
+    if len(info) * findInfoStep(resp.Format()) != len(msg) - 2 {
+      t.Fatalf("%d entries in %v", len(info), msg)
+    }
+  })
+}
+
+func FuzzParseReadByTypeResponse(f *testing.F) {
+  f.Add([]byte{ATT_OPCODE_READ_BY_TYPE_RESPONSE, 3, 3, 0, 99})
+  f.Add([]byte{ATT_OPCODE_READ_BY_TYPE_RESPONSE, 0})
+  f.Add([]byte{ATT_OPCODE_READ_BY_TYPE_RESPONSE, 7, 2, 0, 0x32})
+  f.Fuzz(func(t *testing.T, msg []byte) {
+    resp, err := ParseReadByTypeResponse(msg)
+    if err != nil {
+      return
+    }
+    vals := resp.DataList()
+    if len(vals) * int(resp.Length()) != len(msg) - 2 {
+      t.Fatalf("%d entries in %v", len(vals), msg)
+    }
+  })
+}
+
+func FuzzParseReadByGroupTypeResponse(f *testing.F) {
+  f.Add([]byte{ATT_OPCODE_READ_BY_GROUP_TYPE_RESPONSE, 6, 1, 0, 4, 0,
+    0x0F, 0x18})
+  f.Add([]byte{ATT_OPCODE_READ_BY_GROUP_TYPE_RESPONSE, 2, 1, 0})
+  f.Fuzz(func(t *testing.T, msg []byte) {
+    resp, err := ParseReadByGroupTypeResponse(msg)
+    if err != nil {
+      return
+    }
+    vals := resp.DataList()
+    if len(vals) * int(resp.Length()) != len(msg) - 2 {
+      t.Fatalf("%d entries in %v", len(vals), msg)
+    }
+  })
+}
+
+func FuzzParseHandleRequest(f *testing.F) {
+  f.Add([]byte{ATT_OPCODE_READ_REQUEST, 3, 0})
+  f.Add([]byte{ATT_OPCODE_READ_BLOB_REQUEST, 3, 0, 22, 0})
+  f.Add([]byte{ATT_OPCODE_WRITE_REQUEST, 3, 0, 5})
+  f.Add(append([]byte{ATT_OPCODE_SIGNED_WRITE_COMMAND, 3, 0},
+    make([]byte, 12)...))
+  f.Fuzz(func(t *testing.T, msg []byte) {
+    req, err := ParseHandleRequest(msg)
+    if err != nil {
+      return
+    }
+    req.Opcode()
+    req.Handle()
+    req.Offset()
+    req.Value()
+  })
+}
+
+func FuzzParseHandleValueUpdate(f *testing.F) {
+  f.Add([]byte{ATT_OPCODE_HANDLE_VALUE_NOTIFICATION, 3, 0, 98})
+  f.Add([]byte{ATT_OPCODE_HANDLE_VALUE_INDICATION, 3, 0})
+  f.Fuzz(func(t *testing.T, msg []byte) {
+    update, err := ParseHandleValueUpdate(msg)
+    if err != nil {
+      return
+    }
+    update.Handle()
+    update.Value()
+  })
+}
+
+func FuzzParseRequests(f *testing.F) {
+  f.Add([]byte{ATT_OPCODE_FIND_INFO_REQUEST, 1, 0, 0xff, 0xff})
+  f.Add([]byte{ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST, 1, 0, 0xff, 0xff,
+    0x00, 0x28, 0x0F, 0x18})
+  f.Add([]byte{ATT_OPCODE_READ_BY_TYPE_REQUEST, 1, 0, 0xff, 0xff, 0x03, 0x28})
+  f.Add([]byte{ATT_OPCODE_READ_MULTIPLE_REQUEST, 3, 0, 7, 0})
+  f.Add([]byte{ATT_OPCODE_PREPARE_WRITE_REQUEST, 3, 0, 0, 0, 1, 2})
+  f.Fuzz(func(t *testing.T, msg []byte) {
+    if req, err := ParseFindInfoRequest(msg); err == nil {
+      req.StartHandle()
+      req.EndHandle()
+    }
+    if req, err := ParseFindByTypeValueRequest(msg); err == nil {
+      req.Type()
+      req.Value()
+    }
+    if req, err := ParseReadByTypeRequest(msg); err == nil {
+      req.Type()
+    }
+    if req, err := ParseReadByGroupTypeRequest(msg); err == nil {
+      req.Type()
+    }
+    if req, err := ParseReadMultipleRequest(msg); err == nil {
+      req.Handles()
+    }
+    if req, err := ParsePrepareWriteRequest(msg); err == nil {
+      req.Offset()
+      req.Value()
+    }
+    if req, err := ParseExecuteWriteRequest(msg); err == nil {
+      req.Flags()
+    }
+    if req, err := ParseMTURequest(msg); err == nil {
+      req.MTU()
+    }
+    if resp, err := ParseError(msg); err == nil {
+      resp.Handle()
+    }
+  })
+}
+
+// Routes arbitrary PDUs from a client, or from the peripheral if
+// `fromPeripheral`, as the device's read loop would.
+func FuzzRoute(f *testing.F) {
+  test := newRouterTest(f)
+  // Keep the pipes flowing whatever the router answers
+  go func() {
+    for range test.client.in {
+    }
+  }()
+  go func() {
+    for range test.client2.in {
+    }
+  }()
+  var client *Device
+  test.manager.do(func() {
+    client = test.manager.devices["c"]
+  })
+
+  f.Add(false, []byte{ATT_OPCODE_READ_REQUEST, 13, 0})
+  f.Add(false, []byte{ATT_OPCODE_WRITE_REQUEST, 14, 0, 1, 0})
+  f.Add(false, []byte{ATT_OPCODE_FIND_INFO_REQUEST, 1, 0, 0xff, 0xff})
+  f.Add(false, []byte{ATT_OPCODE_READ_BY_TYPE_REQUEST, 1, 0, 0xff, 0xff,
+    0x03, 0x28})
+  f.Add(false, []byte{ATT_OPCODE_PREPARE_WRITE_REQUEST, 16, 0, 0, 0, 1})
+  f.Add(false, []byte{ATT_OPCODE_EXECUTE_WRITE_REQUEST, 1})
+  f.Add(true, []byte{ATT_OPCODE_HANDLE_VALUE_NOTIFICATION, 3, 0, 98})
+  f.Add(true, []byte{ATT_OPCODE_HANDLE_VALUE_INDICATION, 3, 0, 97})
+  f.Fuzz(func(t *testing.T, fromPeripheral bool, pkt []byte) {
+    // The read loop passes on nonempty requests, commands, notifications
+    // and indications
+    if len(pkt) == 0 || pkt[0] & 1 == 1 &&
+       pkt[0] != ATT_OPCODE_HANDLE_VALUE_NOTIFICATION &&
+       pkt[0] != ATT_OPCODE_HANDLE_VALUE_INDICATION {
+      return
+    }
+    device := client
+    if fromPeripheral {
+      device = test.periph
+    }
+    test.manager.do(func() {
+      test.manager.route(Request{pkt, device})
+    })
+  })
+}
+
+// A request forwarded to the peripheral, whose reply FuzzPeripheralResponse
+// replaces
+type forwarded struct {
+  // Opcode of the request the peripheral receives
+  opcode uint8
+  // Sends the request, returning once it has been answered
+  send   func(test *routerTest) error
+}
+
+// Has the client send `pkt`, failing unless the router's response is a
+// response or a well-formed error.
+func (this *routerTest) clientExchange(pkt []byte) error {
+  resp, err := this.client.exchange(pkt)
+  if err != nil {
+    return err
+  } else if len(resp) == 0 {
+    return errors.New("Empty response")
+  } else if resp[0] == ATT_OPCODE_ERROR && len(resp) != 5 {
+    return errors.New("Malformed error response")
+  }
+  return nil
+}
+
+// Has a client send `pkt` and waits for the router's response.
+func clientRequest(pkt func(test *routerTest) []byte) func(*routerTest) error {
+  return func(test *routerTest) error {
+    return test.clientExchange(pkt(test))
+  }
+}
+
+var FORWARDED = []forwarded{
+  {ATT_OPCODE_READ_REQUEST, clientRequest(func(test *routerTest) []byte {
+    return pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level))
+  })},
+  {ATT_OPCODE_READ_BLOB_REQUEST, clientRequest(func(test *routerTest) []byte {
+    return pdu(ATT_OPCODE_READ_BLOB_REQUEST, test.h(test.level), le16(1))
+  })},
+  {ATT_OPCODE_READ_MULTIPLE_REQUEST,
+    clientRequest(func(test *routerTest) []byte {
+      return pdu(ATT_OPCODE_READ_MULTIPLE_REQUEST, test.h(test.level),
+        test.h(test.control))
+    })},
+  // A run of one handle is read with a Read Request
+  {ATT_OPCODE_READ_REQUEST, clientRequest(func(test *routerTest) []byte {
+    return pdu(ATT_OPCODE_READ_MULTIPLE_REQUEST, le16(1), test.h(test.level))
+  })},
+  {ATT_OPCODE_READ_BY_TYPE_REQUEST,
+    clientRequest(func(test *routerTest) []byte {
+      return pdu(ATT_OPCODE_READ_BY_TYPE_REQUEST, le16(1), le16(0xffff),
+        le16(0x2803))
+    })},
+  {ATT_OPCODE_WRITE_REQUEST, clientRequest(func(test *routerTest) []byte {
+    return pdu(ATT_OPCODE_WRITE_REQUEST, test.h(test.control), []byte{5})
+  })},
+  // Configuring the peripheral for a subscription
+  {ATT_OPCODE_WRITE_REQUEST, func(test *routerTest) error {
+    for _, cccd := range []uint16{GATT_CCCD_NOTIFY, 0} {
+      err := test.clientExchange(pdu(ATT_OPCODE_WRITE_REQUEST,
+        test.h(test.level + 1), le16(cccd)))
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  }},
+  {ATT_OPCODE_PREPARE_WRITE_REQUEST,
+    clientRequest(func(test *routerTest) []byte {
+      return pdu(ATT_OPCODE_PREPARE_WRITE_REQUEST, test.h(test.control),
+        le16(0), []byte{1})
+    })},
+  // Execute, after a Prepare Write the peripheral accepts
+  {ATT_OPCODE_EXECUTE_WRITE_REQUEST, func(test *routerTest) error {
+    for _, pkt := range [][]byte{
+      pdu(ATT_OPCODE_PREPARE_WRITE_REQUEST, test.h(test.control), le16(0),
+        []byte{1}),
+      {ATT_OPCODE_EXECUTE_WRITE_REQUEST, ATT_EXECUTE_WRITE_COMMIT},
+    } {
+      if err := test.clientExchange(pkt); err != nil {
+        return err
+      }
+    }
+    return nil
+  }},
+  // Discovery, reconnection and caching, which Beetle does itself
+  {ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST, func(test *routerTest) error {
+    Discover(test.periph)
+    return nil
+  }},
+  {ATT_OPCODE_READ_BY_TYPE_REQUEST, func(test *routerTest) error {
+    Discover(test.periph)
+    return nil
+  }},
+  {ATT_OPCODE_FIND_INFO_REQUEST, func(test *routerTest) error {
+    Discover(test.periph)
+    return nil
+  }},
+  {ATT_OPCODE_MTU_REQUEST, func(test *routerTest) error {
+    ExchangeMTU(test.periph, ATT_MAX_MTU)
+    return nil
+  }},
+  {ATT_OPCODE_READ_BY_TYPE_REQUEST, func(test *routerTest) error {
+    ReadDatabaseHash(test.periph)
+    return nil
+  }},
+}
+
+// Has the peripheral answer a request of each kind with arbitrary PDUs.
+func FuzzPeripheralResponse(f *testing.F) {
+  test := newRouterTest(f)
+  go func() {
+    for range test.client2.in {
+    }
+  }()
+
+  for i := range FORWARDED {
+    f.Add(uint8(i), []byte{ATT_OPCODE_ERROR})
+    f.Add(uint8(i), []byte{ATT_OPCODE_ERROR, FORWARDED[i].opcode, 3, 0, 0x0A})
+    f.Add(uint8(i), []byte{FORWARDED[i].opcode + 1})
+  }
+  f.Add(uint8(4), []byte{ATT_OPCODE_READ_BY_TYPE_RESPONSE, 7, 2, 0, 0x32})
+  f.Add(uint8(9), []byte{ATT_OPCODE_READ_BY_GROUP_TYPE_RESPONSE, 6, 1, 0,
+    0xff, 0xff, 0x0F, 0x18})
+  f.Add(uint8(11), []byte{ATT_OPCODE_FIND_INFO_RESPONSE, 1, 2, 0, 0x19, 0x2A})
+  f.Fuzz(func(t *testing.T, kind uint8, resp []byte) {
+    // The read loop takes anything else for a request from the peripheral,
+    // leaving the transaction unanswered, and the link carries no longer PDUs
+    if len(resp) == 0 || len(resp) > int(ATT_MAX_MTU) || resp[0] & 1 == 0 ||
+       resp[0] == ATT_OPCODE_HANDLE_VALUE_NOTIFICATION ||
+       resp[0] == ATT_OPCODE_HANDLE_VALUE_INDICATION {
+      return
+    }
+    req := FORWARDED[int(kind) % len(FORWARDED)]
+    test.replyWith(req.opcode, resp)
+    defer test.replyWith(0, nil)
+    if err := req.send(test); err != nil {
+      t.Fatalf("0x%02X answered with %v: %s", req.opcode, resp, err)
+    }
+  })
+}
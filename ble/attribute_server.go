@@ -0,0 +1,365 @@
+package ble
+
+import (
+  "bytes"
+  "io"
+  "sync"
+)
+
+// An attribute hosted by Beetle itself rather than by a remote peripheral
+type attribute struct {
+  handle   uint16
+  uuid     UUID
+  value    []byte
+  // Last handle of the group, for service declarations
+  endGroup uint16
+  readable bool
+  writable bool
+
+  // Callbacks used instead of `value` by virtual devices, if set
+  read     ReadHandler
+  write    WriteHandler
+}
+
+// Answers ATT requests from a local attribute database.
+type attributeServer struct {
+  db  *LocalDatabase
+  mtu uint16
+  // Guards `mtu`, which server initiated packets are also limited to
+  mtuLock sync.Mutex
+  // Signalled when the client confirms an indication
+  confirmations chan struct{}
+  // The client's queued prepared writes
+  prepared []*preparedWrite
+}
+
+type preparedWrite struct {
+  attr   *attribute
+  offset uint16
+  value  []byte
+}
+
+func newAttributeServer(db *LocalDatabase, mtu uint16) *attributeServer {
+  return &attributeServer{db, mtu, sync.Mutex{}, make(chan struct{}, 1), nil}
+}
+
+func (this *attributeServer) linkMTU() uint16 {
+  this.mtuLock.Lock()
+  defer this.mtuLock.Unlock()
+  return this.mtu
+}
+
+// Serves requests read from `conn` until it is closed.
+func (this *attributeServer) serve(conn io.ReadWriter) {
+  for {
+    buf := make([]byte, ATT_MAX_MTU)
+    n, err := conn.Read(buf)
+    if err != nil {
+      return
+    }
+    if n == 0 {
+      continue
+    }
+    if resp := this.respond(buf[0:n]); resp != nil {
+      conn.Write(resp)
+    }
+  }
+}
+
+// Returns the response to a request, or nil for commands and confirmations.
+func (this *attributeServer) respond(pkt []byte) []byte {
+  opcode := pkt[0]
+  switch opcode {
+  case ATT_OPCODE_MTU_REQUEST:
+    mtuReq, err := ParseMTURequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    this.mtuLock.Lock()
+    this.mtu = NegotiateMTU(mtuReq.MTU())
+    this.mtuLock.Unlock()
+    return NewMTUResponse(ATT_MAX_MTU).msg
+  case ATT_OPCODE_FIND_INFO_REQUEST:
+    findReq, err := ParseFindInfoRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    start, end := findReq.StartHandle(), findReq.EndHandle()
+    if start == 0 || start > end {
+      return NewError(opcode, start, 0x01).msg
+    }
+    handles := make(HandleUUIDLst, 0, len(this.db.attrs))
+    for _, attr := range this.db.attrs {
+      if attr.handle >= start && attr.handle <= end {
+        handles = append(handles, HandleUUID{attr.handle, attr.uuid})
+      }
+    }
+    if len(handles) == 0 {
+      return NewError(opcode, start, 0x0A).msg
+    }
+    return NewFindInfoResponse(handles, this.linkMTU()).msg
+  case ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST:
+    findReq, err := ParseFindByTypeValueRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    start, end := findReq.StartHandle(), findReq.EndHandle()
+    if start == 0 || start > end {
+      return NewError(opcode, start, 0x01).msg
+    }
+    vals := make(GroupValueLst, 0, len(this.db.attrs))
+    for _, attr := range this.db.attrs {
+      if attr.handle >= start && attr.handle <= end &&
+         attr.uuid == findReq.Type() && bytes.Equal(attr.value, findReq.Value()) {
+        endGroup := attr.endGroup
+        if endGroup == 0 {
+          endGroup = attr.handle
+        }
+        vals = append(vals, &GroupValue{attr.handle, endGroup, nil})
+      }
+    }
+    if len(vals) == 0 {
+      return NewError(opcode, start, 0x0A).msg
+    }
+    return NewFindByTypeValueResponse(vals, this.linkMTU()).msg
+  case ATT_OPCODE_READ_BY_TYPE_REQUEST:
+    readReq, err := ParseReadByTypeRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    start, end := readReq.StartHandle(), readReq.EndHandle()
+    if start == 0 || start > end {
+      return NewError(opcode, start, 0x01).msg
+    }
+    vals := make(GroupValueLst, 0, len(this.db.attrs))
+    for _, attr := range this.db.attrs {
+      if attr.handle < start || attr.handle > end ||
+         attr.uuid != readReq.Type() {
+        continue
+      }
+      if !attr.readable {
+        if len(vals) == 0 {
+          return NewError(opcode, attr.handle, 0x02).msg
+        }
+        break
+      }
+      vals = append(vals, &GroupValue{attr.handle, 0, this.db.valueOf(attr)})
+    }
+    if len(vals) == 0 {
+      return NewError(opcode, start, 0x0A).msg
+    }
+    return NewReadByTypeResponse(vals, this.linkMTU()).msg
+  case ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST:
+    readReq, err := ParseReadByGroupTypeRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    start, end := readReq.StartHandle(), readReq.EndHandle()
+    if start == 0 || start > end {
+      return NewError(opcode, start, 0x01).msg
+    }
+    attType := readReq.Type()
+    if attType != GATT_PRIMARY_SERVICE_UUID &&
+       attType != GATT_SECONDARY_SERVICE_UUID {
+      return NewError(opcode, start, 0x10).msg
+    }
+    vals := make(GroupValueLst, 0, len(this.db.attrs))
+    for _, attr := range this.db.attrs {
+      if attr.handle >= start && attr.handle <= end && attr.uuid == attType {
+        vals = append(vals, &GroupValue{attr.handle, attr.endGroup, attr.value})
+      }
+    }
+    if len(vals) == 0 {
+      return NewError(opcode, start, 0x0A).msg
+    }
+    return NewReadByGroupTypeResponse(vals, this.linkMTU()).msg
+  case ATT_OPCODE_READ_REQUEST, ATT_OPCODE_READ_BLOB_REQUEST:
+    readReq, err := ParseHandleRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    handle := readReq.Handle()
+    attr := this.db.find(handle)
+    if attr == nil {
+      return NewError(opcode, handle, 0x01).msg
+    }
+    if !attr.readable {
+      return NewError(opcode, handle, 0x02).msg
+    }
+    value := this.db.valueOf(attr)
+    if opcode == ATT_OPCODE_READ_BLOB_REQUEST {
+      offset := int(readReq.Offset())
+      if offset > len(value) {
+        return NewError(opcode, handle, 0x07).msg
+      }
+      value = value[offset:]
+    }
+    resp := append([]byte{opcode + 1}, value...)
+    return FitToMTU(resp, this.linkMTU())
+  case ATT_OPCODE_READ_MULTIPLE_REQUEST:
+    readReq, err := ParseReadMultipleRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    resp := []byte{ATT_OPCODE_READ_MULTIPLE_RESPONSE}
+    for _, handle := range readReq.Handles() {
+      attr := this.db.find(handle)
+      if attr == nil {
+        return NewError(opcode, handle, 0x01).msg
+      }
+      if !attr.readable {
+        return NewError(opcode, handle, 0x02).msg
+      }
+      resp = append(resp, this.db.valueOf(attr)...)
+    }
+    return FitToMTU(resp, this.linkMTU())
+  case ATT_OPCODE_WRITE_REQUEST, ATT_OPCODE_WRITE_COMMAND:
+    writeReq, err := ParseHandleRequest(pkt)
+    if err != nil {
+      if opcode == ATT_OPCODE_WRITE_COMMAND {
+        return nil
+      }
+      return NewError(opcode, 0, 0x04).msg
+    }
+    handle := writeReq.Handle()
+    attr := this.db.find(handle)
+    if attr == nil || !attr.writable {
+      if opcode == ATT_OPCODE_WRITE_COMMAND {
+        return nil
+      }
+      if attr == nil {
+        return NewError(opcode, handle, 0x01).msg
+      }
+      return NewError(opcode, handle, 0x03).msg
+    }
+    value := append([]byte{}, writeReq.Value()...)
+    if attr.write != nil {
+      if code := attr.write(value); code != 0 {
+        if opcode == ATT_OPCODE_WRITE_COMMAND {
+          return nil
+        }
+        return NewError(opcode, handle, code).msg
+      }
+    }
+    this.db.setValue(attr, value)
+    if opcode == ATT_OPCODE_WRITE_COMMAND {
+      return nil
+    }
+    return []byte{ATT_OPCODE_WRITE_RESPONSE}
+  case ATT_OPCODE_PREPARE_WRITE_REQUEST:
+    prepReq, err := ParsePrepareWriteRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    attr := this.db.find(prepReq.Handle())
+    if attr == nil {
+      return NewError(opcode, prepReq.Handle(), 0x01).msg
+    }
+    if !attr.writable {
+      return NewError(opcode, prepReq.Handle(), 0x03).msg
+    }
+    this.prepared = append(this.prepared, &preparedWrite{attr,
+      prepReq.Offset(), append([]byte{}, prepReq.Value()...)})
+    resp := make([]byte, len(pkt))
+    copy(resp, pkt)
+    resp[0] = ATT_OPCODE_PREPARE_WRITE_RESPONSE
+    return resp
+  case ATT_OPCODE_EXECUTE_WRITE_REQUEST:
+    execReq, err := ParseExecuteWriteRequest(pkt)
+    if err != nil {
+      return NewError(opcode, 0, 0x04).msg
+    }
+    prepared := this.prepared
+    this.prepared = nil
+    if execReq.Flags() == ATT_EXECUTE_WRITE_COMMIT {
+      return this.executeWrites(prepared)
+    }
+    return []byte{ATT_OPCODE_EXECUTE_WRITE_RESPONSE}
+  case ATT_OPCODE_HANDLE_VALUE_CONFIRMATION:
+    select {
+    case this.confirmations <- struct{}{}:
+    default:
+    }
+    return nil
+  }
+
+  if opcode & 0x40 != 0 {
+    // Commands don't get responses, even unsupported ones
+    return nil
+  }
+  if opcode & 1 == 1 {
+    // Nor do responses, notifications and indications, which a client
+    // shouldn't send. Nothing awaits an answer to them.
+    return nil
+  }
+  return NewError(opcode, 0, 0x06).msg
+}
+
+// Applies a queue of prepared writes, all of which must succeed before any
+// value is changed.
+func (this *attributeServer) executeWrites(prepared []*preparedWrite) []byte {
+  attrs := make([]*attribute, 0, len(prepared))
+  values := make(map[*attribute][]byte)
+  for _, p := range prepared {
+    value, ok := values[p.attr]
+    if !ok {
+      value = append([]byte{}, this.db.valueOf(p.attr)...)
+      attrs = append(attrs, p.attr)
+    }
+    if int(p.offset) > len(value) {
+      return NewError(ATT_OPCODE_EXECUTE_WRITE_REQUEST, p.attr.handle, 0x07).msg
+    }
+    values[p.attr] = append(value[0:p.offset], p.value...)
+  }
+
+  for _, attr := range attrs {
+    if attr.write != nil {
+      if code := attr.write(values[attr]); code != 0 {
+        return NewError(ATT_OPCODE_EXECUTE_WRITE_REQUEST, attr.handle, code).msg
+      }
+    }
+  }
+  for _, attr := range attrs {
+    this.db.setValue(attr, values[attr])
+  }
+  return []byte{ATT_OPCODE_EXECUTE_WRITE_RESPONSE}
+}
+
+// Builds the handle table a discovery of `attrs` would produce.
+func attributeHandles(attrs []*attribute) map[uint16]*Handle {
+  handles := make(map[uint16]*Handle)
+  var service, char *Handle
+  for _, attr := range attrs {
+    handle := new(Handle)
+    handle.subscribers = make(map[*Device]uint16)
+    handle.handle = attr.handle
+    handle.uuid = attr.uuid
+    handle.cachedValue = attr.value
+
+    switch attr.uuid {
+    case GATT_PRIMARY_SERVICE_UUID, GATT_SECONDARY_SERVICE_UUID:
+      handle.cachedInfinite = true
+      handle.endGroup = attr.endGroup
+      service = handle
+      char = nil
+    case GATT_CHARACTERISTIC_UUID:
+      handle.cachedInfinite = true
+      handle.serviceHandle = service.handle
+      handle.charHandle = uint16(attr.value[1]) | uint16(attr.value[2]) << 8
+      handle.endGroup = service.endGroup
+      if char != nil {
+        char.endGroup = attr.handle - 1
+      }
+      char = handle
+    default:
+      if service != nil {
+        handle.serviceHandle = service.handle
+      }
+      if char != nil {
+        handle.charHandle = char.handle
+      }
+    }
+    handles[attr.handle] = handle
+  }
+  return handles
+}
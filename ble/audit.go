@@ -0,0 +1,241 @@
+package ble
+
+import (
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "os"
+  "time"
+)
+
+// Size past which the audit log is rotated
+const DEFAULT_AUDIT_MAX_SIZE = 10 * 1024 * 1024
+// Number of rotated audit logs kept
+const DEFAULT_AUDIT_KEEP = 5
+// Records queued for writing before the router waits on the audit log
+const AUDIT_QUEUE_LEN = 256
+
+// A client's access to a peripheral's attribute, as written to the audit log
+type AuditRecord struct {
+  Time           time.Time
+  // Client nickname, and user ID if it connected over a Unix domain socket
+  Client         string
+  Uid            *uint32 `json:",omitempty"`
+  Peripheral     string
+  // Handle on the peripheral, 0 when executing prepared writes
+  Handle         uint16
+  Characteristic string  `json:",omitempty"`
+  Opcode         uint8
+  // "read", "write", "writeWithoutResponse", "subscribe" or "unsubscribe"
+  Operation      string
+  // Length of the value read or written, and the value in hex if the log
+  // records values
+  Length         int
+  Value          string  `json:",omitempty"`
+  // "ok", "sent" for writes without response, "denied" by policy or "error"
+  Result         string
+  // ATT error returned to the client
+  Error          uint8   `json:",omitempty"`
+}
+
+// An append-only log of AuditRecords, one JSON object per line. Records are
+// written and synced to disk in the background. Once the file would grow past
+// `maxSize` it is renamed with a ".1" suffix, older logs moving up to ".2"
+// and so on with at most `keep` kept, and a new file is started.
+type AuditLog struct {
+  path    string
+  maxSize int64
+  keep    int
+  // Whether records include the values read and written
+  values  bool
+  file    *os.File
+  size    int64
+  records chan *AuditRecord
+  done    chan struct{}
+  // First error writing a record, reported by Close
+  err     error
+}
+
+func OpenAuditLog(path string, maxSize int64, keep int,
+                  values bool) (*AuditLog, error) {
+  log := &AuditLog{path, maxSize, keep, values, nil, 0,
+    make(chan *AuditRecord, AUDIT_QUEUE_LEN), make(chan struct{}), nil}
+  if err := log.open(); err != nil {
+    return nil, err
+  }
+  go log.run()
+  return log, nil
+}
+
+func (this *AuditLog) open() error {
+  file, err := os.OpenFile(this.path,
+    os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+  if err != nil {
+    return err
+  }
+  info, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return err
+  }
+  this.file = file
+  this.size = info.Size()
+  return nil
+}
+
+func (this *AuditLog) run() {
+  for record := range this.records {
+    // Later records are still written, as the problem (e.g. a full disk)
+    // may pass
+    if err := this.write(record); err != nil && this.err == nil {
+      this.err = err
+    }
+  }
+  if this.file != nil {
+    this.file.Close()
+  }
+  close(this.done)
+}
+
+func (this *AuditLog) write(record *AuditRecord) error {
+  buf, err := json.Marshal(record)
+  if err != nil {
+    return err
+  }
+  buf = append(buf, '\n')
+
+  if this.file != nil && this.size > 0 &&
+     this.size + int64(len(buf)) > this.maxSize {
+    this.file.Close()
+    this.file = nil
+    this.rotate()
+  }
+  if this.file == nil {
+    // Not yet reopened after rotating
+    if err := this.open(); err != nil {
+      return err
+    }
+  }
+
+  n, err := this.file.Write(buf)
+  this.size += int64(n)
+  if err != nil {
+    return err
+  }
+  return this.file.Sync()
+}
+
+func (this *AuditLog) rotate() {
+  for i := this.keep - 1; i >= 1; i-- {
+    os.Rename(fmt.Sprintf("%s.%d", this.path, i),
+      fmt.Sprintf("%s.%d", this.path, i + 1))
+  }
+  if this.keep > 0 {
+    os.Rename(this.path, this.path + ".1")
+  } else {
+    os.Remove(this.path)
+  }
+}
+
+// Queues a record to be written.
+func (this *AuditLog) Log(record *AuditRecord) {
+  this.records <- record
+}
+
+// Writes any queued records and closes the log, returning the first error
+// writing any record, in which case records were lost. The log may not be
+// used afterwards.
+func (this *AuditLog) Close() error {
+  close(this.records)
+  <-this.done
+  return this.err
+}
+
+// Installs the log accesses are recorded in, or stops recording if `log` is
+// nil. The previous log, if any, is closed, and any error from closing it is
+// returned.
+func (this *Manager) SetAuditLog(log *AuditLog) error {
+  var old *AuditLog
+  this.do(func() {
+    old = this.auditLog
+    this.auditLog = log
+  })
+  if old != nil {
+    return old.Close()
+  }
+  return nil
+}
+
+func auditOperation(opcode uint8, handle *Handle, value []byte) string {
+  switch opcode {
+  case ATT_OPCODE_READ_REQUEST, ATT_OPCODE_READ_BLOB_REQUEST,
+       ATT_OPCODE_READ_MULTIPLE_REQUEST, ATT_OPCODE_READ_BY_TYPE_REQUEST:
+    return "read"
+  case ATT_OPCODE_WRITE_COMMAND, ATT_OPCODE_SIGNED_WRITE_COMMAND:
+    return "writeWithoutResponse"
+  }
+  if opcode == ATT_OPCODE_WRITE_REQUEST && handle != nil &&
+     handle.uuid == GATT_CLIENT_CONFIGURATION_UUID {
+    for _, b := range value {
+      if b != 0 {
+        return "subscribe"
+      }
+    }
+    return "unsubscribe"
+  }
+  return "write"
+}
+
+// Records an access by `client` to `handle` on `peripheral` in the audit log,
+// if there is one. As with policy, declarations and Beetle's own attributes
+// aren't recorded.
+func (this *Manager) audit(client, peripheral *Device, handle *Handle,
+                           opcode uint8, value []byte, result string,
+                           errorCode uint8) {
+  if this.auditLog == nil || peripheral == this.local {
+    return
+  }
+
+  record := &AuditRecord{time.Now(), client.nick, nil,
+    peripheral.addr, 0, "", opcode, auditOperation(opcode, handle, value),
+    len(value), "", result, errorCode}
+  if client.creds != nil {
+    uid := client.creds.Uid
+    record.Uid = &uid
+  }
+  if handle != nil {
+    ctx := contextOf(peripheral, handle)
+    if ctx == nil {
+      return
+    }
+    record.Handle = handle.handle
+    if ctx.inCharacteristic {
+      record.Characteristic = ctx.characteristic.String()
+    }
+  }
+  if this.auditLog.values {
+    record.Value = hex.EncodeToString(value)
+  }
+  this.auditLog.Log(record)
+}
+
+// Records an access forwarded to the peripheral once it has responded. The
+// value of a read is taken from the response.
+func (this *Manager) auditResponse(client, peripheral *Device, handle *Handle,
+                                   opcode uint8, value []byte, resp []byte,
+                                   err error) {
+  if this.auditLog == nil {
+    return
+  }
+  if err != nil {
+    this.audit(client, peripheral, handle, opcode, value, "error", 0x0E)
+  } else if resp[0] == ATT_OPCODE_ERROR && len(resp) == 5 {
+    this.audit(client, peripheral, handle, opcode, value, "error", resp[4])
+  } else {
+    if opcode == ATT_OPCODE_READ_REQUEST ||
+       opcode == ATT_OPCODE_READ_BLOB_REQUEST {
+      value = resp[1:]
+    }
+    this.audit(client, peripheral, handle, opcode, value, "ok", 0)
+  }
+}
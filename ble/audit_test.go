@@ -0,0 +1,56 @@
+package ble
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestAuditLogWrites(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "audit.log")
+  log, err := OpenAuditLog(path, DEFAULT_AUDIT_MAX_SIZE, 1, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  log.Log(&AuditRecord{Time: time.Now(), Client: "c", Peripheral: "p",
+    Handle: 3, Operation: "read", Result: "ok"})
+  if err := log.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  buf, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var record AuditRecord
+  if err := json.Unmarshal(buf, &record); err != nil {
+    t.Fatalf("%q: %s", buf, err)
+  }
+  if record.Client != "c" || record.Handle != 3 || record.Result != "ok" {
+    t.Fatalf("read back %+v", record)
+  }
+}
+
+func TestAuditLogWriteError(t *testing.T) {
+  dir := filepath.Join(t.TempDir(), "logs")
+  if err := os.Mkdir(dir, 0700); err != nil {
+    t.Fatal(err)
+  }
+  // Every record after the first is written to a new file
+  log, err := OpenAuditLog(filepath.Join(dir, "audit.log"), 1, 1, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := os.RemoveAll(dir); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 2; i++ {
+    log.Log(&AuditRecord{Time: time.Now(), Operation: "read"})
+  }
+  if err := log.Close(); err == nil {
+    t.Fatalf("lost record not reported")
+  }
+}
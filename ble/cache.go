@@ -0,0 +1,148 @@
+package ble
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// On-disk form of a discovered Handle
+type cachedHandle struct {
+  Handle        uint16
+  UUID          UUID
+  EndGroup      uint16
+  Value         []byte
+  Infinite      bool
+  ServiceHandle uint16
+  CharHandle    uint16
+}
+
+// On-disk form of a peripheral's discovered handle table
+type discoveryCache struct {
+  Address      string
+  DatabaseHash []byte
+  Handles      []cachedHandle
+}
+
+// Returns the path of the discovery cache file for a device, or "" if caching
+// is disabled.
+func (this *Manager) cachePath(device *Device) string {
+  dir := this.cacheDirectory()
+  if dir == "" {
+    return ""
+  }
+  name := strings.NewReplacer(":", "_", "/", "_").Replace(device.addr)
+  return filepath.Join(dir, name + ".json")
+}
+
+func (this *Manager) cacheDirectory() string {
+  this.cacheMu.Lock()
+  defer this.cacheMu.Unlock()
+  return this.cacheDir
+}
+
+// Writes a device's discovered handles, along with its Database Hash if it
+// exposes one, to the discovery cache.
+func (this *Manager) saveCache(device *Device, handles map[uint16]*Handle) {
+  path := this.cachePath(device)
+  if path == "" {
+    return
+  }
+
+  hash, err := ReadDatabaseHash(device)
+  if err != nil {
+    return
+  }
+
+  cache := discoveryCache{device.addr, hash, make([]cachedHandle, 0)}
+  for _, handle := range sortHandles(handles) {
+    var value []byte
+    if handle.cachedInfinite {
+      value = handle.cachedValue
+    }
+    cache.Handles = append(cache.Handles, cachedHandle{handle.handle,
+      handle.uuid, handle.endGroup, value, handle.cachedInfinite,
+      handle.serviceHandle, handle.charHandle})
+  }
+
+  buf, err := json.Marshal(&cache)
+  if err == nil {
+    err = os.MkdirAll(filepath.Dir(path), 0700)
+  }
+  if err == nil {
+    err = ioutil.WriteFile(path, buf, 0600)
+  }
+  // Without a cache the peripheral is just discovered again next time
+  if err != nil && Debug {
+    fmt.Printf("%s: could not write discovery cache: %s\n", device.addr, err)
+  }
+}
+
+// Returns a device's handles from the discovery cache, or nil if there is no
+// usable cache entry, including when the peripheral's Database Hash no longer
+// matches the cached one.
+func (this *Manager) loadCache(device *Device) map[uint16]*Handle {
+  cache := this.readCache(device)
+  if cache == nil {
+    return nil
+  }
+
+  if !this.cacheCurrent(device, cache) {
+    this.invalidateCache(device)
+    return nil
+  }
+
+  handles := make(map[uint16]*Handle)
+  for _, c := range cache.Handles {
+    handle := new(Handle)
+    handle.subscribers = make(map[*Device]uint16)
+    handle.handle = c.Handle
+    handle.uuid = c.UUID
+    handle.endGroup = c.EndGroup
+    handle.cachedValue = c.Value
+    handle.cachedInfinite = c.Infinite
+    if c.Infinite {
+      handle.cachedTime = time.Now()
+    }
+    handle.serviceHandle = c.ServiceHandle
+    handle.charHandle = c.CharHandle
+    handles[c.Handle] = handle
+  }
+  return handles
+}
+
+// Returns a device's cache entry, or nil if there is no valid one.
+func (this *Manager) readCache(device *Device) *discoveryCache {
+  path := this.cachePath(device)
+  if path == "" {
+    return nil
+  }
+
+  buf, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil
+  }
+  var cache discoveryCache
+  if err := json.Unmarshal(buf, &cache); err != nil ||
+     cache.Address != device.addr {
+    return nil
+  }
+  return &cache
+}
+
+// Checks the peripheral's current Database Hash against the cached one.
+func (this *Manager) cacheCurrent(device *Device, cache *discoveryCache) bool {
+  hash, err := ReadDatabaseHash(device)
+  return err == nil && bytes.Equal(hash, cache.DatabaseHash)
+}
+
+func (this *Manager) invalidateCache(device *Device) {
+  if path := this.cachePath(device); path != "" {
+    os.Remove(path)
+  }
+}
@@ -1,13 +1,23 @@
 package ble
 
 import (
+  "errors"
   "fmt"
   "io"
+  "sort"
+  "sync"
   "time"
 )
 
 var Debug bool = false
 
+// ATT transactions not completed within this time of being sent fail, and the
+// link they were made on is considered failed (Core Spec Vol 3, Part F, 3.3.3)
+const ATT_TRANSACTION_TIMEOUT = 30 * time.Second
+
+var ErrTransactionTimeout = errors.New("ATT transaction timed out")
+var ErrLinkFailed = errors.New("ATT link failed")
+
 type Response struct {
   value []byte
   err   error
@@ -16,6 +26,9 @@ type Response struct {
 type Transaction struct {
   packet        []byte
   respChan      chan Response
+  // The transaction fails, leaving the link alone, if it hasn't been sent by
+  // this time
+  deadline      time.Time
 }
 
 type Handle struct {
@@ -28,15 +41,22 @@ type Handle struct {
   cachedInfinite bool
   serviceHandle uint16
   charHandle uint16
-  subscribers map[*Device]bool
+  // Client characteristic configuration requested by each subscriber
+  subscribers map[*Device]uint16
 }
 
 type Device struct {
   addr          string
   fd            io.ReadWriteCloser
   handles       map[uint16]*Handle
-  handleOffset  int
-  highestHandle int
+  // The same handles sorted by handle number, for range queries
+  sorted        HandleLst
+  highestHandle uint16
+  mtu           uint16
+
+  // Peripherals mapped into this device's handle space when acting as a
+  // client, sorted by offset
+  ranges        []*HandleRange
 
   // Responses for client initiated transactions stream
   clientRespChan chan Response
@@ -49,99 +69,361 @@ type Device struct {
 
   connInfo       *ConnInfo
   first          bool
+
+  // Set for clients connected over a Unix domain socket
+  creds          *Credentials
+  // The manager's nickname for the device, "" once it has been removed
+  nick           string
+
+  // Peripheral holding this client's queued prepared writes, if any
+  prepareQueue   *Device
+  // Client whose prepared writes are queued on this peripheral, if any
+  prepareOwner   *Device
+
+  // Indications awaiting confirmation by this client, oldest (in flight)
+  // first
+  indications    []*queuedIndication
+
+  // Closed once a transaction times out, the link drops or the device is
+  // disconnected
+  failed         chan struct{}
+  failOnce       sync.Once
+  // Guards `fd`, `failed` and `failOnce`, which are replaced on reconnect
+  // while the device's I/O goroutines use them
+  linkMu         sync.Mutex
+
+  // Closed when the device is explicitly disconnected
+  done           chan struct{}
+  // Notified when the link drops
+  linkLost       chan *Device
+  // Re-establishes the link to a peripheral, nil if it can't be redialed
+  redial         func() (io.ReadWriteCloser, *ConnInfo, error)
 }
 
 func (device *Device) String() string {
-  return fmt.Sprintf("%s\t%d", device.addr, device.handleOffset)
+  if device.Failed() {
+    return fmt.Sprintf("%s\t%d\t(link lost)", device.addr, device.highestHandle)
+  }
+  if device.creds != nil {
+    return fmt.Sprintf("%s\t%d\t%s", device.addr, device.highestHandle,
+      device.creds)
+  }
+  return fmt.Sprintf("%s\t%d", device.addr, device.highestHandle)
+}
+
+func (device *Device) MTU() uint16 {
+  return device.mtu
+}
+
+func (device *Device) Credentials() *Credentials {
+  return device.creds
 }
 
 func (device *Device) StrHandles() string {
   result := ""
-  for i, handle := range device.handles {
-    result += fmt.Sprintf("0x%02X\t0x%02X:\t%v\t%v\t0x%02X\t0x%02X\tsubscribers: %d\n",
-      i,
-      handle.handle, handle.uuid, handle.cachedValue,
+  for _, handle := range device.sorted {
+    result += fmt.Sprintf("0x%02X\t0x%02X:\t%s\t%v\t0x%02X\t0x%02X\tsubscribers: %d\n",
+      handle.handle,
+      handle.handle, handle.uuid.Describe(), handle.cachedValue,
       handle.charHandle, handle.serviceHandle, len(handle.subscribers))
   }
   return result
 }
 
+// Replaces the device's handle table, e.g. after discovery.
+func (this *Device) setHandles(handles map[uint16]*Handle) {
+  this.handles = handles
+  this.sorted = sortHandles(handles)
+  this.highestHandle = 0
+  if len(this.sorted) > 0 {
+    this.highestHandle = this.sorted[len(this.sorted) - 1].handle
+  }
+}
+
+// Returns the device's handles from `start` to `end` inclusive, in order.
+func (this *Device) handlesIn(start, end uint16) HandleLst {
+  i := sort.Search(len(this.sorted), func(i int) bool {
+    return this.sorted[i].handle >= start
+  })
+  j := sort.Search(len(this.sorted), func(j int) bool {
+    return this.sorted[j].handle > end
+  })
+  if i >= j {
+    return nil
+  }
+  return this.sorted[i:j]
+}
+
+type HandleLst []*Handle
+
+func (this HandleLst) Len() int {
+  return len(this)
+}
+
+func (this HandleLst) Less(i, j int) bool {
+  return this[i].handle < this[j].handle
+}
+
+func (this HandleLst) Swap(i, j int) {
+  tmp := this[i]
+  this[i] = this[j]
+  this[j] = tmp
+}
+
+// Returns the handles in `handles` sorted by handle number.
+func sortHandles(handles map[uint16]*Handle) HandleLst {
+  result := make(HandleLst, 0, len(handles))
+  for _, handle := range handles {
+    result = append(result, handle)
+  }
+  sort.Sort(result)
+  return result
+}
+
+// Returns the client characteristic configuration to write to the peripheral:
+// the bitwise union of every subscriber's configuration.
+func (handle *Handle) effectiveCCCD() uint16 {
+  result := uint16(0)
+  for _, value := range handle.subscribers {
+    result |= value
+  }
+  return result
+}
+
+// Returns the client characteristic configuration descriptor of the
+// characteristic whose value handle is `valueHandle`, or nil if there is none.
+func (this *Device) cccdFor(valueHandle *Handle) *Handle {
+  char, ok := this.handles[valueHandle.charHandle]
+  if !ok {
+    return nil
+  }
+  for i := valueHandle.charHandle; i <= char.endGroup && i != 0; i++ {
+    handle, ok := this.handles[i]
+    if !ok {
+      break
+    }
+    if handle.uuid == GATT_CLIENT_CONFIGURATION_UUID {
+      return handle
+    }
+  }
+  return nil
+}
+
 func NewDevice(addr string, serverReqChan chan Request, fd io.ReadWriteCloser,
                 ci *ConnInfo) *Device {
-  return &Device{addr, fd, make(map[uint16]*Handle), -1, -1,
+  return &Device{addr, fd, make(map[uint16]*Handle), nil, 0, ATT_DEFAULT_MTU,
+    nil,
     make(chan Response), serverReqChan,
-    make(chan []byte), make(chan Transaction), ci, true}
+    make(chan []byte), make(chan Transaction), ci, true, nil, "", nil, nil, nil,
+    make(chan struct{}), sync.Once{}, sync.Mutex{}, make(chan struct{}), nil,
+    nil}
 }
 
+// Returns the device's current link.
+func (this *Device) link() io.ReadWriteCloser {
+  this.linkMu.Lock()
+  defer this.linkMu.Unlock()
+  return this.fd
+}
+
+// Returns the channel closed when the current link fails.
+func (this *Device) failedChan() chan struct{} {
+  this.linkMu.Lock()
+  defer this.linkMu.Unlock()
+  return this.failed
+}
+
+// Marks the link as failed. Pending and future transactions fail immediately.
+func (this *Device) fail() {
+  this.linkMu.Lock()
+  defer this.linkMu.Unlock()
+  this.failOnce.Do(func() {
+    close(this.failed)
+  })
+}
+
+func (this *Device) Failed() bool {
+  select {
+  case <-this.failedChan():
+    return true
+  default:
+    return false
+  }
+}
+
+// Closes the device's link and stops its I/O goroutines. Packets sent to the
+// device afterwards are dropped and transactions fail.
 func (this *Device) Disconnect() {
-  close(this.clientRespChan)
-  close(this.writeChan)
-  close(this.transactChan)
-  this.fd.Close()
+  close(this.done)
+  this.fail()
+  this.link().Close()
 }
 
 func (this *Device) Start() {
 
   // Pull packets off `writeChan` and write to socket
   go func() {
-    for req := range this.writeChan {
-      if Debug {
-        fmt.Printf("%s <= %v\n", this.addr, req)
+    for {
+      select {
+      case req := <-this.writeChan:
+        if Debug {
+          fmt.Printf("%s <= %v\n", this.addr, req)
+        }
+        this.link().Write(req)
+      case <-this.done:
+        return
       }
-      this.fd.Write(req)
     }
   }()
 
   go func() {
-    for req := range this.transactChan {
+    for {
+      var req Transaction
+      select {
+      case req = <-this.transactChan:
+      case <-this.done:
+        return
+      }
       if Debug {
         fmt.Printf("%s <- %v\n", this.addr, req)
       }
-      this.writeChan <- req.packet
-      resp :=<-this.clientRespChan
-      req.respChan <-resp
+      if this.Failed() {
+        req.respChan <-Response{nil, ErrLinkFailed}
+        continue
+      }
+      req.respChan <-this.await(req.packet, req.deadline)
     }
   }()
 
-  // Read from socket and route to appropriate handler
-  go func() {
-    for {
-      buf := make([]byte, 64)
-      n, err := this.fd.Read(buf)
-      if err != nil || n == 0 {
-        return
-      }
+  go this.readLoop(this.link())
+}
 
-      buf = buf[0:n]
-      if Debug {
-        fmt.Printf("%s -> %v\n", this.addr, buf)
+// Reads from socket and routes to appropriate handler until the link drops
+func (this *Device) readLoop(fd io.ReadWriteCloser) {
+  for {
+    buf := make([]byte, ATT_MAX_MTU)
+    n, err := fd.Read(buf)
+    if err != nil || n == 0 {
+      select {
+      case <-this.done:
+      default:
+        this.fail()
+        if this.linkLost != nil {
+          this.linkLost <-this
+        }
       }
-      if (buf[0] & 1 == 1 && buf[0] != ATT_OPCODE_HANDLE_VALUE_NOTIFICATION &&
-          buf[0] != ATT_OPCODE_HANDLE_VALUE_INDICATION) ||
-          buf[0] == ATT_OPCODE_HANDLE_VALUE_CONFIRMATION { // Response packet
-        this.clientRespChan <-Response{buf, nil}
-      } else {
-        this.serverReqChan <-Request{buf, this}
+      return
+    }
+
+    buf = buf[0:n]
+    if Debug {
+      fmt.Printf("%s -> %v\n", this.addr, buf)
+    }
+    if buf[0] & 1 == 1 && buf[0] != ATT_OPCODE_HANDLE_VALUE_NOTIFICATION &&
+        buf[0] != ATT_OPCODE_HANDLE_VALUE_INDICATION { // Response packet
+      select {
+      case this.clientRespChan <-Response{buf, nil}:
+      case <-this.failedChan():
+        // Late response on a failed link
       }
+    } else {
+      this.serverReqChan <-Request{buf, this}
     }
-  }()
+  }
+}
+
+// Replaces a dropped link with a newly established one and resumes reading
+// from it. Handles and subscriptions are kept.
+func (this *Device) reconnect(fd io.ReadWriteCloser, ci *ConnInfo) {
+  this.linkMu.Lock()
+  this.fd = fd
+  this.failed = make(chan struct{})
+  this.failOnce = sync.Once{}
+  this.linkMu.Unlock()
+  this.connInfo = ci
+  go this.readLoop(fd)
+}
+
+// Writes a request unless `deadline` passes first, then waits for its
+// response, failing the link if it takes longer than the ATT transaction
+// timeout.
+func (this *Device) await(packet []byte, deadline time.Time) Response {
+  failed := this.failedChan()
+  if !time.Now().Before(deadline) {
+    return Response{nil, ErrTransactionTimeout}
+  }
+  send := time.NewTimer(deadline.Sub(time.Now()))
+  select {
+  case this.writeChan <- packet:
+    send.Stop()
+  case <-send.C:
+    // Nothing was sent, so the link is still usable
+    return Response{nil, ErrTransactionTimeout}
+  case <-failed:
+    send.Stop()
+    return Response{nil, ErrLinkFailed}
+  }
 
+  timer := time.NewTimer(ATT_TRANSACTION_TIMEOUT)
+  defer timer.Stop()
+  select {
+  case resp :=<-this.clientRespChan:
+    return resp
+  case <-timer.C:
+    return this.timeout()
+  case <-failed:
+    return Response{nil, ErrLinkFailed}
+  }
+}
+
+func (this *Device) timeout() Response {
+  if Debug {
+    fmt.Printf("%s: ATT transaction timed out\n", this.addr)
+  }
+  this.fail()
+  // No further PDUs may be sent on the bearer, so drop the link
+  this.link().Close()
+  return Response{nil, ErrTransactionTimeout}
 }
 
 func (this *Device) Respond(packet []byte) {
-  this.writeChan <-packet
+  this.WriteCmd(packet)
 }
 
 func (this *Device) WriteCmd(packet []byte) {
-  this.writeChan <-packet
+  select {
+  case this.writeChan <-packet:
+  case <-this.done:
+  }
 }
 
 func (this *Device) Transaction(packet []byte, cb func([]byte, error)) {
+  this.TransactionWithDeadline(packet,
+    time.Now().Add(ATT_TRANSACTION_TIMEOUT), cb)
+}
+
+// Like Transaction, but fails with ErrTransactionTimeout if the request has not
+// been sent by `deadline`, e.g. because earlier transactions are still queued.
+// Once sent, the peripheral has ATT_TRANSACTION_TIMEOUT to respond.
+func (this *Device) TransactionWithDeadline(packet []byte, deadline time.Time,
+                                            cb func([]byte, error)) {
   go func() {
-    respChan := make(chan Response)
-    this.transactChan <-Transaction{packet,respChan}
-    resp :=<-respChan
+    resp := this.transact(packet, deadline)
     cb(resp.value, resp.err)
   }()
 }
 
+// Synchronous version of Transaction.
+func (this *Device) transact(packet []byte, deadline time.Time) Response {
+  respChan := make(chan Response)
+  timer := time.NewTimer(deadline.Sub(time.Now()))
+  defer timer.Stop()
+  select {
+  case this.transactChan <-Transaction{packet, respChan, deadline}:
+  case <-timer.C:
+    return Response{nil, ErrTransactionTimeout}
+  case <-this.done:
+    return Response{nil, ErrLinkFailed}
+  }
+  return <-respChan
+}
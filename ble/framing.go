@@ -0,0 +1,62 @@
+package ble
+
+import (
+  "errors"
+  "io"
+  "net"
+  "sync"
+)
+
+// A stream connection, such as TCP, carrying ATT PDUs each preceded by its
+// length as a little-endian uint16. Streams don't keep the boundaries between
+// writes, so PDUs written back to back (e.g. a response and a notification)
+// could otherwise be read as one.
+type framedConn struct {
+  net.Conn
+  // Guards reads, so each Read returns one whole PDU
+  readMu sync.Mutex
+}
+
+// Wraps a stream connection so each Write sends one PDU and each Read returns
+// one.
+func NewFramedConn(conn net.Conn) net.Conn {
+  return &framedConn{conn, sync.Mutex{}}
+}
+
+// Writes `pdu` and its length with a single write, so writes from different
+// goroutines don't interleave.
+func (this *framedConn) Write(pdu []byte) (int, error) {
+  if len(pdu) > 0xffff {
+    return 0, errors.New("PDU too long to frame")
+  }
+  buf := make([]byte, 2 + len(pdu))
+  buf[0] = byte(len(pdu) & 0xff)
+  buf[1] = byte(len(pdu) >> 8)
+  copy(buf[2:], pdu)
+  if _, err := this.Conn.Write(buf); err != nil {
+    return 0, err
+  }
+  return len(pdu), nil
+}
+
+// Reads the next nonempty PDU into `buf`.
+func (this *framedConn) Read(buf []byte) (int, error) {
+  this.readMu.Lock()
+  defer this.readMu.Unlock()
+  for {
+    var prefix [2]byte
+    if _, err := io.ReadFull(this.Conn, prefix[:]); err != nil {
+      return 0, err
+    }
+    n := int(prefix[0]) | int(prefix[1]) << 8
+    if n > len(buf) {
+      return 0, errors.New("PDU longer than read buffer")
+    }
+    if _, err := io.ReadFull(this.Conn, buf[:n]); err != nil {
+      return 0, err
+    }
+    if n > 0 {
+      return n, nil
+    }
+  }
+}
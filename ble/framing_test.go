@@ -0,0 +1,34 @@
+package ble
+
+import (
+  "bytes"
+  "net"
+  "testing"
+)
+
+func TestFramedConn(t *testing.T) {
+  conn, remote := net.Pipe()
+  defer conn.Close()
+  defer remote.Close()
+  framed := NewFramedConn(conn)
+
+  // Two PDUs arriving in one segment, as a stream may deliver them
+  go remote.Write([]byte{2, 0, ATT_OPCODE_READ_RESPONSE, 7,
+                         0, 0,
+                         3, 0, ATT_OPCODE_HANDLE_VALUE_NOTIFICATION, 3, 0})
+  for _, want := range [][]byte{{ATT_OPCODE_READ_RESPONSE, 7},
+                                {ATT_OPCODE_HANDLE_VALUE_NOTIFICATION, 3, 0}} {
+    buf := make([]byte, ATT_MAX_MTU)
+    n, err := framed.Read(buf)
+    if err != nil || !bytes.Equal(buf[:n], want) {
+      t.Fatalf("read %v, %v, want %v", buf[:n], err, want)
+    }
+  }
+
+  go framed.Write([]byte{ATT_OPCODE_READ_REQUEST, 3, 0})
+  buf := make([]byte, 5)
+  if _, err := remote.Read(buf); err != nil ||
+     !bytes.Equal(buf, []byte{3, 0, ATT_OPCODE_READ_REQUEST, 3, 0}) {
+    t.Fatalf("wrote %v, %v", buf, err)
+  }
+}
@@ -0,0 +1,157 @@
+package ble
+
+import (
+  "time"
+)
+
+type ConfirmPolicy int
+
+const (
+  // Confirm an indication to the peripheral once every subscriber has
+  // confirmed it (or timed out)
+  CONFIRM_ALL ConfirmPolicy = iota
+  // Confirm an indication to the peripheral as soon as any subscriber has
+  // confirmed it
+  CONFIRM_FIRST
+)
+
+// How long a subscriber has to confirm an indication before Beetle gives up on
+// it, per the ATT transaction timeout
+const DEFAULT_INDICATION_TIMEOUT = 30 * time.Second
+
+// An indication from a peripheral being fanned out to its subscribers
+type indication struct {
+  peripheral *Device
+  // Subscribers that have not yet confirmed the indication
+  pending    map[*Device]bool
+  // Whether the indication has been confirmed to the peripheral
+  confirmed  bool
+}
+
+// An indication queued for delivery to a single client. A client may only have
+// one unconfirmed indication outstanding, so indications from different
+// peripherals are delivered one at a time.
+type queuedIndication struct {
+  ind    *indication
+  client *Device
+  pkt    []byte
+  timer  *time.Timer
+}
+
+// Fans an indication from `peripheral` out to every subscriber of the
+// indicated handle.
+func (this *Manager) indicate(peripheral *Device, proxyHandle *Handle,
+                              pkt []byte) {
+  handleNum := uint16(pkt[1]) + uint16(pkt[2]) << 8
+  ind := &indication{peripheral, make(map[*Device]bool), false}
+
+  for dev, cccd := range proxyHandle.subscribers {
+    if cccd & GATT_CCCD_INDICATE == 0 ||
+       this.checkAccess(dev, peripheral, proxyHandle, ACCESS_SUBSCRIBE) != 0 {
+      continue
+    }
+    r := dev.rangeOf(peripheral)
+    if r == nil {
+      continue
+    }
+    clientHandle := r.toClient(handleNum)
+    clientPkt := make([]byte, len(pkt))
+    copy(clientPkt, pkt)
+    clientPkt = FitToMTU(clientPkt, dev.mtu)
+    clientPkt[1] = byte(clientHandle & 0xff)
+    clientPkt[2] = byte(clientHandle >> 8)
+
+    ind.pending[dev] = true
+    this.queueIndication(ind, dev, clientPkt)
+  }
+
+  this.maybeConfirm(ind, false)
+}
+
+// Queues an indication for delivery to `client`, sending it right away if the
+// client has no other indication outstanding.
+func (this *Manager) queueIndication(ind *indication, client *Device,
+                                     pkt []byte) {
+  client.indications = append(client.indications,
+    &queuedIndication{ind, client, pkt, nil})
+  if len(client.indications) == 1 {
+    this.sendIndication(client)
+  }
+}
+
+// Sends the indication at the head of the client's queue, if any.
+func (this *Manager) sendIndication(client *Device) {
+  if len(client.indications) == 0 {
+    return
+  }
+  q := client.indications[0]
+  q.timer = time.AfterFunc(this.IndicationTimeout, func() {
+    this.indicationTimeouts <- q
+  })
+  client.WriteCmd(q.pkt)
+}
+
+// Handles a Handle Value Confirmation from a client for the indication at the
+// head of its queue.
+func (this *Manager) confirmIndication(client *Device) {
+  if len(client.indications) == 0 {
+    return
+  }
+  q := client.indications[0]
+  q.timer.Stop()
+  client.indications = client.indications[1:]
+  delete(q.ind.pending, client)
+  this.maybeConfirm(q.ind, true)
+  this.sendIndication(client)
+}
+
+// Gives up on a client that failed to confirm an indication in time. The client
+// is treated as no longer waiting on the indication, but does not count as
+// having confirmed it.
+func (this *Manager) timeoutIndication(q *queuedIndication) {
+  client := q.client
+  if len(client.indications) == 0 || client.indications[0] != q {
+    // Already confirmed or dropped
+    return
+  }
+  client.indications = client.indications[1:]
+  delete(q.ind.pending, client)
+  this.maybeConfirm(q.ind, false)
+  this.sendIndication(client)
+}
+
+// Drops indications queued for `client`, either all of them or only those from
+// `peripheral` if it is non-nil.
+func (this *Manager) dropIndications(client *Device, peripheral *Device) {
+  remaining := make([]*queuedIndication, 0, len(client.indications))
+  for i, q := range client.indications {
+    if peripheral != nil && q.ind.peripheral != peripheral {
+      remaining = append(remaining, q)
+      continue
+    }
+    if i == 0 && q.timer != nil {
+      q.timer.Stop()
+    }
+    delete(q.ind.pending, client)
+    this.maybeConfirm(q.ind, false)
+  }
+
+  inFlight := len(client.indications) > 0 && len(remaining) > 0 &&
+    client.indications[0] == remaining[0]
+  client.indications = remaining
+  if !inFlight {
+    this.sendIndication(client)
+  }
+}
+
+// Confirms the indication to the peripheral once the manager's confirm policy
+// is satisfied. `byClient` is true when a subscriber has just confirmed it.
+func (this *Manager) maybeConfirm(ind *indication, byClient bool) {
+  if ind.confirmed {
+    return
+  }
+  if len(ind.pending) == 0 || (byClient && this.confirmPolicy == CONFIRM_FIRST) {
+    ind.confirmed = true
+    ind.peripheral.WriteCmd([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+  }
+}
@@ -0,0 +1,154 @@
+package ble
+
+import (
+  "errors"
+  "sync"
+)
+
+var GAP_SERVICE_UUID UUID = UUID16(0x1800)
+var GATT_SERVICE_UUID UUID = UUID16(0x1801)
+var GAP_DEVICE_NAME_UUID UUID = UUID16(0x2A00)
+var GAP_APPEARANCE_UUID UUID = UUID16(0x2A01)
+
+// Characteristic properties
+const (
+  GATT_PROP_READ              uint8 = 0x02
+  GATT_PROP_WRITE_NO_RESPONSE uint8 = 0x04
+  GATT_PROP_WRITE             uint8 = 0x08
+  GATT_PROP_NOTIFY            uint8 = 0x10
+  GATT_PROP_INDICATE          uint8 = 0x20
+)
+
+const DEFAULT_DEVICE_NAME = "Beetle"
+
+// An attribute database hosted by Beetle itself. Attributes are added in
+// handle order, starting at handle 1, with the Add* methods.
+type LocalDatabase struct {
+  attrs   []*attribute
+  service *attribute
+  // Guards attribute values, which may be read and written while the
+  // database is being served
+  mu      sync.Mutex
+}
+
+func NewLocalDatabase() *LocalDatabase {
+  return &LocalDatabase{make([]*attribute, 0), nil, sync.Mutex{}}
+}
+
+// Returns the database Beetle serves to every client: a Generic Access service
+// with the device name and appearance, and a Generic Attribute service with
+// Service Changed.
+func NewBeetleDatabase(name string, appearance uint16) *LocalDatabase {
+  db := NewLocalDatabase()
+  db.AddService(GAP_SERVICE_UUID)
+  db.AddCharacteristic(GAP_DEVICE_NAME_UUID, GATT_PROP_READ, []byte(name))
+  db.AddCharacteristic(GAP_APPEARANCE_UUID, GATT_PROP_READ,
+    []byte{byte(appearance & 0xff), byte(appearance >> 8)})
+  db.AddService(GATT_SERVICE_UUID)
+  db.AddCharacteristic(GATT_SERVICE_CHANGED_UUID, GATT_PROP_INDICATE,
+    []byte{0, 0, 0, 0})
+  return db
+}
+
+func (this *LocalDatabase) add(uuid UUID, value []byte,
+                               readable, writable bool) *attribute {
+  attr := &attribute{uint16(len(this.attrs) + 1), uuid, value, 0,
+    readable, writable, nil, nil}
+  this.attrs = append(this.attrs, attr)
+  if this.service != nil {
+    this.service.endGroup = attr.handle
+  }
+  return attr
+}
+
+// Adds a primary service declaration and returns its handle. Characteristics
+// added after it belong to the service.
+func (this *LocalDatabase) AddService(uuid UUID) uint16 {
+  // The declaration isn't part of the previous service
+  this.service = nil
+  this.service = this.add(GATT_PRIMARY_SERVICE_UUID, uuid.Bytes(), true,
+    false)
+  this.service.endGroup = this.service.handle
+  return this.service.handle
+}
+
+// Adds a characteristic to the last service and returns its value handle.
+// Characteristics that notify or indicate also get a client characteristic
+// configuration descriptor.
+func (this *LocalDatabase) AddCharacteristic(uuid UUID, props uint8,
+                                             value []byte) uint16 {
+  h := uint16(len(this.attrs) + 2)
+  decl := append([]byte{props, byte(h & 0xff), byte(h >> 8)}, uuid.Bytes()...)
+  this.add(GATT_CHARACTERISTIC_UUID, decl, true, false)
+  this.add(uuid, value, props & GATT_PROP_READ != 0,
+    props & (GATT_PROP_WRITE | GATT_PROP_WRITE_NO_RESPONSE) != 0)
+  if props & (GATT_PROP_NOTIFY | GATT_PROP_INDICATE) != 0 {
+    this.add(GATT_CLIENT_CONFIGURATION_UUID, []byte{0, 0}, true, true)
+  }
+  return h
+}
+
+// Adds a descriptor to the last characteristic and returns its handle.
+func (this *LocalDatabase) AddDescriptor(uuid UUID, value []byte,
+                                         writable bool) uint16 {
+  return this.add(uuid, value, true, writable).handle
+}
+
+func (this *LocalDatabase) find(handle uint16) *attribute {
+  if handle == 0 || int(handle) > len(this.attrs) {
+    return nil
+  }
+  return this.attrs[handle - 1]
+}
+
+// Returns the handle of the first attribute of type `uuid`, or 0 if there is
+// none.
+func (this *LocalDatabase) Find(uuid UUID) uint16 {
+  for _, attr := range this.attrs {
+    if attr.uuid == uuid {
+      return attr.handle
+    }
+  }
+  return 0
+}
+
+func (this *LocalDatabase) Value(handle uint16) []byte {
+  attr := this.find(handle)
+  if attr == nil {
+    return nil
+  }
+  this.mu.Lock()
+  defer this.mu.Unlock()
+  return attr.value
+}
+
+func (this *LocalDatabase) SetValue(handle uint16, value []byte) error {
+  attr := this.find(handle)
+  if attr == nil {
+    return errors.New("No such handle")
+  }
+  this.setValue(attr, value)
+  return nil
+}
+
+// Returns the current value of an attribute, from its read handler if it has
+// one.
+func (this *LocalDatabase) valueOf(attr *attribute) []byte {
+  if attr.read != nil {
+    return attr.read()
+  }
+  this.mu.Lock()
+  defer this.mu.Unlock()
+  return attr.value
+}
+
+func (this *LocalDatabase) setValue(attr *attribute, value []byte) {
+  this.mu.Lock()
+  defer this.mu.Unlock()
+  attr.value = value
+}
+
+// The last handle in the database
+func (this *LocalDatabase) HighestHandle() uint16 {
+  return uint16(len(this.attrs))
+}
@@ -2,10 +2,13 @@ package ble
 
 import (
   "errors"
+  "fmt"
   "time"
   "io"
   "net"
   "os"
+  "sort"
+  "sync"
 )
 
 type Request struct {
@@ -13,16 +16,80 @@ type Request struct {
   device *Device
 }
 
+// Proxies GATT traffic between devices. The device registry, exposures,
+// handle tables, subscriptions and indication queues are owned by the router
+// goroutine (RunRouter); exported methods hand their work to it and may be
+// called from any other goroutine.
 type Manager struct {
-  Devices map[string]*Device
-  globalHandleOffset int
+  devices     map[string]*Device
   requestChan chan Request
   hciSock     *os.File
+
+  // Peripherals exposed to each client: exposures[client][peripheral]
+  exposures   map[*Device]map[*Device]bool
+
+  confirmPolicy      ConfirmPolicy
+  // Set before starting the router
+  IndicationTimeout  time.Duration
+  indicationTimeouts chan *queuedIndication
+
+  // Set before starting the router
+  ReconnectInterval  time.Duration
+  linkLost           chan *Device
+  linkRestored       chan *restoredLink
+
+  // Directory of per-peripheral discovery caches, empty to disable caching.
+  // Guarded by `cacheMu` since discovery runs off the router goroutine.
+  cacheDir           string
+  cacheMu            sync.Mutex
+  discovered         chan *discovery
+
+  // Beetle's own attributes, mapped at the start of every client's handle
+  // space
+  localDB            *LocalDatabase
+  local              *Device
+
+  // Access control policy, nil to allow every access, and the file it was
+  // loaded from
+  policy             *accessPolicy
+  policyFile         string
+  // Log of clients' accesses, nil if they aren't recorded
+  auditLog           *AuditLog
+
+  // Functions to run on the router goroutine
+  calls              chan func()
 }
 
 func NewManager(hciSock *os.File) (*Manager) {
-  return &Manager{make(map[string]*Device, 0), 0,
-    make(chan Request), hciSock}
+  manager := &Manager{make(map[string]*Device, 0),
+    make(chan Request), hciSock, make(map[*Device]map[*Device]bool),
+    CONFIRM_ALL, DEFAULT_INDICATION_TIMEOUT, make(chan *queuedIndication),
+    DEFAULT_RECONNECT_INTERVAL, make(chan *Device), make(chan *restoredLink),
+    "", sync.Mutex{}, make(chan *discovery),
+    NewBeetleDatabase(DEFAULT_DEVICE_NAME, 0), nil, nil, "", nil,
+    make(chan func())}
+  manager.local = manager.newLocalDevice(manager.localDB)
+  return manager
+}
+
+// Sets the directory of the discovery cache, or disables caching if `dir` is
+// empty.
+func (this *Manager) SetCacheDir(dir string) {
+  this.cacheMu.Lock()
+  defer this.cacheMu.Unlock()
+  this.cacheDir = dir
+}
+
+func (this *Manager) SetConfirmPolicy(policy ConfirmPolicy) {
+  this.do(func() {
+    this.confirmPolicy = policy
+  })
+}
+
+// Sets the device name presented to clients in Beetle's Generic Access
+// service.
+func (this *Manager) SetName(name string) {
+  this.localDB.SetValue(this.localDB.Find(GAP_DEVICE_NAME_UUID), []byte(name))
 }
 
 func (this *Manager) ConnectTo(addrType uint8, addr string, nick string) error {
@@ -38,21 +105,145 @@ func (this *Manager) ConnectTo(addrType uint8, addr string, nick string) error {
 
   ci := GetConnInfo(f)
 
-  this.AddDeviceForConn(addr, nick, f, ci)
+  device := this.newDevice(addr, f, ci)
+  device.redial = func() (io.ReadWriteCloser, *ConnInfo, error) {
+    f, err := NewBLE(NewL2Sockaddr(4, remoteAddr, addrType), addr)
+    if err != nil {
+      return nil, nil, err
+    }
+    return f, GetConnInfo(f), nil
+  }
+  this.addDevice(nick, device)
 
   return nil
 }
 
+// Connects to a peripheral, such as beetle-sim, over TCP. PDUs are framed with
+// their lengths, as described in framing.go.
 func (this *Manager) ConnectTCP(addr string, nick string) (error) {
   conn, err := net.Dial("tcp", addr)
   if err != nil {
     return err
   }
-  this.AddDeviceForConn("tcp://" + addr, nick, conn, nil)
+  device := this.newDevice("tcp://" + addr, NewFramedConn(conn), nil)
+  device.redial = func() (io.ReadWriteCloser, *ConnInfo, error) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+      return nil, nil, err
+    }
+    return NewFramedConn(conn), nil, nil
+  }
+  this.addDevice(nick, device)
   return nil
 }
 
+// Bounds on the delay before accepting again after a temporary error, which
+// doubles with each consecutive failure
+const MIN_ACCEPT_DELAY = 5 * time.Millisecond
+const MAX_ACCEPT_DELAY = time.Second
+
+// Accepts connections on `ln` until it is closed, handing each to `accepted`.
+// Temporary errors (e.g. running out of file descriptors) are retried with
+// backoff.
+func acceptLoop(ln net.Listener, accepted func(conn net.Conn)) {
+  delay := time.Duration(0)
+  for {
+    conn, err := ln.Accept()
+    if ne, ok := err.(net.Error); ok && ne.Temporary() {
+      if delay == 0 {
+        delay = MIN_ACCEPT_DELAY
+      } else if delay *= 2; delay > MAX_ACCEPT_DELAY {
+        delay = MAX_ACCEPT_DELAY
+      }
+      if Debug {
+        fmt.Printf("%s: accept failed: %s\n", ln.Addr(), err)
+      }
+      time.Sleep(delay)
+      continue
+    } else if err != nil {
+      if Debug && !errors.Is(err, net.ErrClosed) {
+        fmt.Printf("%s: accept failed: %s\n", ln.Addr(), err)
+      }
+      return
+    }
+    delay = 0
+    accepted(conn)
+  }
+}
+
+// Listens for incoming TCP connections from applications acting as GATT
+// clients. Each accepted connection is added as a device, nicknamed by its
+// remote address, and started without discovery. Closing the returned listener
+// stops accepting connections.
+func (this *Manager) ListenTCP(addr string) (net.Listener, error) {
+  ln, err := net.Listen("tcp", addr)
+  if err != nil {
+    return nil, err
+  }
+
+  go acceptLoop(ln, func(conn net.Conn) {
+    nick := "tcp://" + conn.RemoteAddr().String()
+    device := this.AddDeviceForConn(nick, nick, conn, nil)
+    device.Start()
+  })
+  return ln, nil
+}
+
+// Listens on a SOCK_SEQPACKET Unix domain socket for local applications acting
+// as GATT clients. Each ATT PDU is a single packet. The peer's process
+// credentials are recorded on the resulting device. Closing the returned
+// listener stops accepting connections and removes the socket.
+func (this *Manager) ListenUnix(path string) (net.Listener, error) {
+  // Replace a stale socket left by a previous run, but nothing else
+  if info, err := os.Lstat(path); err == nil {
+    if info.Mode() & os.ModeSocket == 0 {
+      return nil, errors.New(path + " exists and is not a socket")
+    }
+    if err := os.Remove(path); err != nil {
+      return nil, err
+    }
+  }
+  ln, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+  if err != nil {
+    return nil, err
+  }
 
+  connNum := 0
+  go acceptLoop(ln, func(conn net.Conn) {
+    creds, err := GetPeerCredentials(conn.(*net.UnixConn))
+    if err != nil {
+      if Debug {
+        fmt.Printf("%s: %s\n", path, err)
+      }
+      conn.Close()
+      return
+    }
+    nick := fmt.Sprintf("unix://%s#%d", path, connNum)
+    connNum++
+    device := this.newDevice(nick, conn, nil)
+    device.creds = creds
+    this.addDevice(nick, device)
+    device.Start()
+  })
+  return ln, nil
+}
+
+// Requests a connection interval of `interval` on every device's link.
+// Returns the first nonzero HCI result.
+func (this *Manager) SetInterval(interval uint16) int {
+  result := 0
+  this.do(func() {
+    for _, device := range this.devices {
+      if res := this.ConnUpdate(device, interval); res != 0 {
+        result = res
+        return
+      }
+    }
+  })
+  return result
+}
+
+// Must be called on the router goroutine.
 func (this *Manager) ConnUpdate(device *Device, interval uint16) int {
   if device.connInfo != nil {
     return HCIConnUpdate(this.hciSock, device.connInfo.HCIHandle, interval, interval, 0, 0x0C80)
@@ -63,60 +254,176 @@ func (this *Manager) ConnUpdate(device *Device, interval uint16) int {
 
 func (this *Manager) AddDeviceForConn(addr string, nick string,
                             f io.ReadWriteCloser, ci *ConnInfo) (*Device) {
+  device := this.newDevice(addr, f, ci)
+  this.addDevice(nick, device)
+  return device
+}
+
+// Creates a device routed by this manager. Fields other goroutines read, such
+// as `redial` and `creds`, are set before the device is added.
+func (this *Manager) newDevice(addr string, f io.ReadWriteCloser,
+                               ci *ConnInfo) *Device {
   device := NewDevice(addr, this.requestChan, f, ci)
-  this.Devices[nick] = device
+  device.linkLost = this.linkLost
+  return device
+}
+
+func (this *Manager) addDevice(nick string, device *Device) {
+  this.do(func() {
+    device.mapRange(this.local)
+    device.nick = nick
+    this.devices[nick] = device
+  })
+}
+
+// Returns the device nicknamed `nick`.
+func (this *Manager) lookup(nick string) (*Device, error) {
+  var device *Device
+  this.do(func() {
+    device = this.devices[nick]
+  })
+  if device == nil {
+    return nil, errors.New("No such device")
+  }
+  return device, nil
+}
+
+// Adds a virtual device. Its handles are known up front, so it is started
+// right away and can be served to clients without discovery.
+func (this *Manager) AddVirtualDevice(nick string,
+                                      vd *VirtualDevice) *Device {
+  // Built before serving starts, as serving resets attribute values
+  handles := attributeHandles(vd.attrs)
+  conn, serverConn := net.Pipe()
+  go vd.serve(serverConn, ATT_MAX_MTU)
+
+  device := this.newDevice("virtual://" + vd.name, conn, nil)
+  device.mtu = ATT_MAX_MTU
+  device.setHandles(handles)
+  this.addDevice(nick, device)
+  device.Start()
   return device
 }
 
 func (this *Manager) StartNoDiscover(nick string) error {
-  device, ok := this.Devices[nick]
-  if ok {
-    device.Start()
-    return nil
-  } else {
-    return errors.New("No such device")
+  device, err := this.lookup(nick)
+  if err != nil {
+    return err
   }
+  device.Start()
+  return nil
 }
 
 func (this *Manager) Start(nick string) error {
-  device, ok := this.Devices[nick]
-  if ok {
-    return this.StartDevice(device)
-  } else {
-    return errors.New("No such device")
+  device, err := this.lookup(nick)
+  if err != nil {
+    return err
   }
+  return this.StartDevice(device)
 }
 
+// Starts a peripheral, negotiates its MTU and discovers its handles. The
+// exchanges with the peripheral run on the calling goroutine; the results are
+// applied on the router goroutine.
 func (this *Manager) StartDevice(device *Device) error {
   device.Start()
 
-  lastHandle := uint16(0)
+  mtu, err := ExchangeMTU(device, ATT_MAX_MTU)
+  if err != nil {
+    device.link().Close()
+    return err
+  }
+
+  handles := this.loadCache(device)
+  if handles == nil {
+    handles, err = Discover(device)
+    if err != nil {
+      device.link().Close()
+      return err
+    }
+    this.saveCache(device, handles)
+  }
 
-  services, err := DiscoverServices(device)
+  this.do(func() {
+    if this.nickOf(device) == "" {
+      err = errors.New("Device disconnected")
+      return
+    }
+    device.mtu = mtu
+    device.setHandles(handles)
+    this.subscribeServiceChanged(device)
+
+    // Map the peripheral into the namespace of every client it is served to
+    for client, exposed := range this.exposures {
+      if exposed[device] {
+        r, mapErr := client.mapRange(device)
+        if mapErr != nil {
+          err = mapErr
+          return
+        }
+        this.rangeChanged(client, r)
+      }
+    }
+  })
+  return err
+}
+
+// Discards a started peripheral's cached handles and runs full discovery
+// again. Subscriptions to handles that are unchanged are kept.
+func (this *Manager) Rediscover(nick string) error {
+  device, err := this.lookup(nick)
   if err != nil {
-    device.fd.Close()
     return err
   }
+  this.invalidateCache(device)
+
+  handles, err := Discover(device)
+  if err != nil {
+    return err
+  }
+  this.saveCache(device, handles)
+  this.do(func() {
+    err = this.applyDiscovery(device, handles)
+  })
+  return err
+}
+
+// Runs full service, characteristic and descriptor discovery on a peripheral.
+func Discover(device *Device) (map[uint16]*Handle, error) {
+  handles := make(map[uint16]*Handle)
+
+  services := make([]*GroupValue, 0)
+  serviceTypes := make(map[*GroupValue]UUID)
+  for _, serviceType := range []UUID{GATT_PRIMARY_SERVICE_UUID,
+                                     GATT_SECONDARY_SERVICE_UUID} {
+    found, err := DiscoverServices(device, serviceType)
+    if err != nil {
+      return nil, err
+    }
+    for _, service := range found {
+      serviceTypes[service] = serviceType
+    }
+    services = append(services, found...)
+  }
 
   for _,service := range services {
     handle := new(Handle)
-    handle.subscribers = make(map[*Device]bool)
+    handle.subscribers = make(map[*Device]uint16)
     handle.handle = service.handle
-    handle.uuid = GATT_PRIMARY_SERVICE_UUID
+    handle.uuid = serviceTypes[service]
     handle.cachedTime = time.Now()
     handle.cachedInfinite = true
     handle.cachedValue = service.value
     handle.endGroup = service.endGroup
-    device.handles[service.handle] = handle
+    handles[service.handle] = handle
     chars, err := DiscoverCharacteristics(device, service.handle,
                        service.endGroup)
     if err != nil {
-      device.fd.Close()
-      return err
+      return nil, err
     }
     for _,char := range chars {
       handle := new(Handle)
-      handle.subscribers = make(map[*Device]bool)
+      handle.subscribers = make(map[*Device]uint16)
       handle.handle = char.handle
       handle.uuid = GATT_CHARACTERISTIC_UUID
       handle.cachedTime = time.Now()
@@ -124,28 +431,27 @@ func (this *Manager) StartDevice(device *Device) error {
       handle.cachedValue = char.value
       handle.serviceHandle = service.handle
       handle.charHandle = uint16(char.value[1]) + (uint16(char.value[2]) << 8)
-      device.handles[char.handle] = handle
+      handles[char.handle] = handle
     }
 
     for i := 0; i < len(chars) - 1; i++ {
       char := chars[i]
       startGroup := char.handle + 1
-      endGroup := chars[i + 1].handle
-      device.handles[char.handle].endGroup = endGroup
+      endGroup := chars[i + 1].handle - 1
+      handles[char.handle].endGroup = endGroup
       handleInfos, err := DiscoverHandles(device, startGroup, endGroup)
       if err != nil {
-        device.fd.Close()
-        return err
+        return nil, err
       }
       for _, handleInfo := range(handleInfos) {
         handle := new(Handle)
-        handle.subscribers = make(map[*Device]bool)
+        handle.subscribers = make(map[*Device]uint16)
         handle.handle = handleInfo.handle
         handle.uuid = handleInfo.uuid
         handle.cachedInfinite = false
         handle.serviceHandle = service.handle
         handle.charHandle = char.handle
-        device.handles[handleInfo.handle] = handle
+        handles[handleInfo.handle] = handle
       }
     }
 
@@ -156,78 +462,221 @@ func (this *Manager) StartDevice(device *Device) error {
     char := chars[len(chars) - 1]
     startGroup := char.handle + 1
     endGroup := service.endGroup
-    device.handles[char.handle].endGroup = endGroup
+    handles[char.handle].endGroup = endGroup
     handleInfos, err := DiscoverHandles(device, startGroup, endGroup)
     if err != nil {
-      device.fd.Close()
-      return err
+      return nil, err
     }
     for _, handleInfo := range(handleInfos) {
       handle := new(Handle)
-      handle.subscribers = make(map[*Device]bool)
+      handle.subscribers = make(map[*Device]uint16)
       handle.handle = handleInfo.handle
       handle.uuid = handleInfo.uuid
       handle.cachedInfinite = false
       handle.serviceHandle = service.handle
       handle.charHandle = char.handle
-      device.handles[handleInfo.handle] = handle
-      lastHandle = handleInfo.handle
+      handles[handleInfo.handle] = handle
     }
 
   }
 
-  device.handleOffset = this.globalHandleOffset
-  device.highestHandle = int(lastHandle) + device.handleOffset
-  this.globalHandleOffset += int(lastHandle)
+  return handles, nil
+}
+
+func (this *Manager) DisconnectFrom(nick string) error {
+  var err error
+  this.do(func() {
+    device, ok := this.devices[nick]
+    if !ok {
+      err = errors.New("No such device")
+      return
+    }
+    this.removeDevice(nick, device)
+  })
+  return err
+}
 
+// Returns the nicknames of all devices, sorted.
+func (this *Manager) Nicks() []string {
+  nicks := make([]string, 0)
+  this.do(func() {
+    for nick := range this.devices {
+      nicks = append(nicks, nick)
+    }
+  })
+  sort.Strings(nicks)
+  return nicks
+}
 
-  return nil
+// Describes every device, one per line, sorted by nickname.
+func (this *Manager) StrDevices() string {
+  result := ""
+  this.do(func() {
+    nicks := make([]string, 0, len(this.devices))
+    for nick := range this.devices {
+      nicks = append(nicks, nick)
+    }
+    sort.Strings(nicks)
+    for _, nick := range nicks {
+      result += fmt.Sprintf("%s:\t%s\n", nick, this.devices[nick])
+    }
+  })
+  return result
 }
 
-func (this *Manager) DisconnectFrom(nick string) error {
-  device, ok := this.Devices[nick]
+func (this *Manager) StrHandles(nick string) (string, error) {
+  var result string
+  var err error
+  this.do(func() {
+    device, ok := this.devices[nick]
+    if !ok {
+      err = errors.New("No such device")
+      return
+    }
+    result = device.StrHandles()
+  })
+  return result, err
+}
+
+func (this *Manager) StrRanges(nick string) (string, error) {
+  var result string
+  var err error
+  this.do(func() {
+    device, ok := this.devices[nick]
+    if !ok {
+      err = errors.New("No such device")
+      return
+    }
+    result = device.StrRanges()
+  })
+  return result, err
+}
+
+func (this *Manager) removeDevice(nick string, device *Device) {
+  this.cancelPreparedWrites(device)
+  this.dropIndications(device, nil)
+  device.Disconnect()
+
+  delete(this.devices, nick)
+  device.nick = ""
+
+  if client := device.prepareOwner; client != nil {
+    client.prepareQueue = nil
+  }
+
+  // Drop the device both as a client and as a peripheral
+  for peripheral := range this.exposures[device] {
+    this.unsubscribe(device, peripheral)
+  }
+  this.unsubscribe(device, this.local)
+  delete(this.exposures, device)
+  for client, exposed := range this.exposures {
+    delete(exposed, device)
+    r := client.rangeOf(device)
+    client.unmapRange(device)
+    this.dropIndications(client, device)
+    this.rangeChanged(client, r)
+  }
+}
+
+// Exposes the handles of the peripheral `from` to the client `to`.
+func (this *Manager) Serve(from string, to string) error {
+  var err error
+  this.do(func() {
+    err = this.serve(from, to)
+  })
+  return err
+}
+
+func (this *Manager) serve(from string, to string) error {
+  peripheral, ok := this.devices[from]
   if !ok {
-    return errors.New("No such device")
+    return errors.New("No such device " + from)
+  }
+  client, ok := this.devices[to]
+  if !ok {
+    return errors.New("No such device " + to)
+  }
+  if peripheral == client {
+    return errors.New("Cannot serve a device to itself")
   }
 
-  device.Disconnect()
+  exposed, ok := this.exposures[client]
+  if !ok {
+    exposed = make(map[*Device]bool)
+    this.exposures[client] = exposed
+  }
+  exposed[peripheral] = true
 
-  delete(this.Devices, nick)
-
-  // TODO(alevy): This is really really inefficient. Structuring subscriptions
-  // better would make this easier. For our purposes at the moment, 10s of
-  // devices with 10s of handles, so the iteration is probably not so bad. At
-  // the limit, this could be 16 thousand iterations for each device, which is
-  // a lot.
-  for _,d := range this.Devices {
-    for _, handle := range d.handles {
-      if _, ok := handle.subscribers[device]; ok {
-        delete(handle.subscribers, device)
-        if len(handle.subscribers) == 0 {
-          // This was the last subscriber, so unsubscribe.
-
-          // Iterate through characteristic to find a client configuration
-          char := d.handles[handle.charHandle]
-          for i := handle.charHandle; i <= char.endGroup; i++ {
-            handle, ok = d.handles[i]
-            if !ok {
-              break
-            }
-            if handle.uuid == GATT_CLIENT_CONFIGURATION_UUID {
-              // adjust handle offset
-              h := i - uint16(d.handleOffset)
-              // write a zero
-              d.Transaction(
-                []byte{ATT_OPCODE_WRITE_REQUEST, byte(h & 0xff), byte(h >> 8), 0, 0},
-                func(resp []byte, err error){});
-              break
-            }
-          }
-        }
-      }
+  // Peripherals that have not been discovered yet are mapped by StartDevice
+  if peripheral.highestHandle > 0 {
+    r, err := client.mapRange(peripheral)
+    if err != nil {
+      delete(exposed, peripheral)
+      return err
     }
+    this.rangeChanged(client, r)
+  }
+  return nil
+}
+
+// Revokes access to the peripheral `from` by the client `to`, dropping any
+// subscriptions the client held on it.
+func (this *Manager) Unserve(from string, to string) error {
+  var err error
+  this.do(func() {
+    err = this.unserve(from, to)
+  })
+  return err
+}
+
+func (this *Manager) unserve(from string, to string) error {
+  peripheral, ok := this.devices[from]
+  if !ok {
+    return errors.New("No such device " + from)
+  }
+  client, ok := this.devices[to]
+  if !ok {
+    return errors.New("No such device " + to)
   }
 
+  if !this.exposures[client][peripheral] {
+    return errors.New(from + " is not served to " + to)
+  }
+  delete(this.exposures[client], peripheral)
+  r := client.rangeOf(peripheral)
+  client.unmapRange(peripheral)
+  if client.prepareQueue == peripheral {
+    this.cancelPreparedWrites(client)
+  }
+  this.dropIndications(client, peripheral)
+  this.unsubscribe(client, peripheral)
+  this.rangeChanged(client, r)
   return nil
 }
 
+// Removes `client` from the subscribers of every handle on `peripheral`,
+// rewriting the client configuration on the peripheral for handles whose
+// effective configuration changes as a result.
+func (this *Manager) unsubscribe(client *Device, peripheral *Device) {
+  d := peripheral
+  for _, handle := range d.sorted {
+    if _, ok := handle.subscribers[client]; ok {
+      before := handle.effectiveCCCD()
+      delete(handle.subscribers, client)
+      after := handle.effectiveCCCD()
+      if before == after {
+        continue
+      }
+
+      cccd := d.cccdFor(handle)
+      if cccd != nil {
+        h := cccd.handle
+        d.Transaction(
+          []byte{ATT_OPCODE_WRITE_REQUEST, byte(h & 0xff), byte(h >> 8),
+                 byte(after & 0xff), byte(after >> 8)},
+          func(resp []byte, err error){});
+      }
+    }
+  }
+}
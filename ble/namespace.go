@@ -0,0 +1,149 @@
+package ble
+
+import (
+  "errors"
+  "fmt"
+  "sort"
+)
+
+// A contiguous block of a client's handle space mapped onto the handles of a
+// single peripheral. A remote handle `h` on `device` appears to the client as
+// `h + offset`, so the range covers client handles `offset + 1` to `end`.
+type HandleRange struct {
+  device *Device
+  offset uint16
+  end    uint16
+}
+
+func (this *HandleRange) String() string {
+  return fmt.Sprintf("0x%04X-0x%04X\t%s", this.offset + 1, this.end,
+    this.device.addr)
+}
+
+// Translates a remote handle on the range's peripheral to the client's handle
+// space. Group end handles past the peripheral's highest handle (e.g. 0xFFFF
+// for the last service) are clamped to the end of the range.
+func (this *HandleRange) toClient(handle uint16) uint16 {
+  if handle > this.device.highestHandle {
+    return this.end
+  }
+  return handle + this.offset
+}
+
+// Translates the range's peripheral's response to `reqOpcode` on the client's
+// `handle`, rewriting the handle in an error response to the client's handle
+// space. Anything but the expected response or a well-formed error response
+// becomes an Unlikely Error.
+func (this *HandleRange) responseToClient(reqOpcode uint8, handle uint16,
+                                          resp []byte) []byte {
+  if resp[0] == reqOpcode + 1 {
+    return resp
+  }
+  e, err := ParseError(resp)
+  if err != nil || resp[0] != ATT_OPCODE_ERROR {
+    return NewError(reqOpcode, handle, 0x0E).msg
+  }
+  h := e.Handle()
+  if h != 0 {
+    h = this.toClient(h)
+  }
+  return NewError(e.ReqOpcode(), h, e.ErrorCode()).msg
+}
+
+// Returns the index of the first range in this client's namespace ending at or
+// after `handle`, or len(ranges) if there is none.
+func (this *Device) rangeIndex(handle uint16) int {
+  return sort.Search(len(this.ranges), func(i int) bool {
+    return this.ranges[i].end >= handle
+  })
+}
+
+// Returns the range in this client's namespace containing `handle`, or nil if
+// the handle is unmapped.
+func (this *Device) rangeFor(handle uint16) *HandleRange {
+  i := this.rangeIndex(handle)
+  if i < len(this.ranges) && handle > this.ranges[i].offset {
+    return this.ranges[i]
+  }
+  return nil
+}
+
+// Calls `f` for every handle mapped into this client's namespace from `start`
+// to `end` inclusive, in client handle order.
+func (this *Device) eachHandle(start, end uint16,
+                               f func(r *HandleRange, handle *Handle)) {
+  for i := this.rangeIndex(start); i < len(this.ranges); i++ {
+    r := this.ranges[i]
+    if r.offset >= end {
+      break
+    }
+    remoteStart := uint16(1)
+    if start > r.offset {
+      remoteStart = start - r.offset
+    }
+    remoteEnd := r.end - r.offset
+    if end < r.end {
+      remoteEnd = end - r.offset
+    }
+    for _, handle := range r.device.handlesIn(remoteStart, remoteEnd) {
+      f(r, handle)
+    }
+  }
+}
+
+// Returns the range in this client's namespace mapped onto `peripheral`, or nil
+// if the peripheral is not mapped.
+func (this *Device) rangeOf(peripheral *Device) *HandleRange {
+  for _, r := range this.ranges {
+    if r.device == peripheral {
+      return r
+    }
+  }
+  return nil
+}
+
+// Maps `peripheral` into this client's namespace at the lowest free block
+// large enough to hold all of its handles. Ranges are kept sorted by offset.
+func (this *Device) mapRange(peripheral *Device) (*HandleRange, error) {
+  if r := this.rangeOf(peripheral); r != nil {
+    return r, nil
+  }
+
+  size := uint32(peripheral.highestHandle)
+  offset := uint32(0)
+  i := 0
+  for ; i < len(this.ranges); i++ {
+    if offset + size <= uint32(this.ranges[i].offset) {
+      break
+    }
+    offset = uint32(this.ranges[i].end)
+  }
+  if offset + size > 0xffff {
+    return nil, errors.New("Client handle space exhausted")
+  }
+
+  r := &HandleRange{peripheral, uint16(offset), uint16(offset + size)}
+  this.ranges = append(this.ranges, nil)
+  copy(this.ranges[i + 1:], this.ranges[i:])
+  this.ranges[i] = r
+  return r, nil
+}
+
+// Removes `peripheral` from this client's namespace, leaving its block free for
+// reuse by later mappings.
+func (this *Device) unmapRange(peripheral *Device) {
+  for i, r := range this.ranges {
+    if r.device == peripheral {
+      this.ranges = append(this.ranges[:i], this.ranges[i + 1:]...)
+      return
+    }
+  }
+}
+
+func (this *Device) StrRanges() string {
+  result := ""
+  for _, r := range this.ranges {
+    result += fmt.Sprintf("%s\n", r)
+  }
+  return result
+}
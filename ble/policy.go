@@ -0,0 +1,296 @@
+package ble
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "regexp"
+  "strings"
+)
+
+// An operation a client performs on a peripheral's attribute
+type Access int
+
+const (
+  ACCESS_READ Access = iota
+  ACCESS_WRITE
+  ACCESS_WRITE_NO_RESPONSE
+  ACCESS_SUBSCRIBE
+)
+
+var ACCESS_NAMES = map[string]Access{
+  "read": ACCESS_READ,
+  "write": ACCESS_WRITE,
+  "writeWithoutResponse": ACCESS_WRITE_NO_RESPONSE,
+  "subscribe": ACCESS_SUBSCRIBE,
+}
+
+// An access control policy, as read from a policy file. Rules are tried in
+// order and the first one matching an access decides it.
+type Policy struct {
+  // "allow" or "deny", for accesses no rule matches. Defaults to "allow".
+  Default string
+  Rules   []PolicyRule
+}
+
+// Empty fields match anything.
+type PolicyRule struct {
+  // Nicknames, in which "*" matches any text, e.g. "unix://*"
+  Client         string
+  Peripheral     string
+  // User ID of a client connected over a Unix domain socket
+  Uid            *uint32
+  // A 16-bit assigned number, e.g. "180D", or a 128-bit UUID in canonical form
+  Service        string
+  Characteristic string
+  // Any of "read", "write", "writeWithoutResponse" and "subscribe"
+  Access         []string
+  // "allow", "deny", or "unauthorized" to deny with Insufficient
+  // Authorization rather than Read/Write Not Permitted
+  Action         string
+}
+
+// A parsed PolicyRule
+type policyRule struct {
+  // nil to match any nickname
+  client         *regexp.Regexp
+  peripheral     *regexp.Regexp
+  uid            *uint32
+  service        *UUID
+  characteristic *UUID
+  // Accesses the rule applies to, nil for all
+  access         map[Access]bool
+  // ATT error to deny with, or 0 to allow
+  errorCode      uint8
+}
+
+type accessPolicy struct {
+  rules     []*policyRule
+  errorCode uint8
+}
+
+// The service and characteristic an attribute belongs to, which rules are
+// matched against
+type attributeContext struct {
+  service        UUID
+  characteristic UUID
+  // Whether `characteristic` is known
+  inCharacteristic bool
+}
+
+func parseAction(action string) (uint8, error) {
+  switch action {
+  case "", "allow":
+    return 0, nil
+  case "deny":
+    // Resolved to Read or Write Not Permitted per access
+    return 0x02, nil
+  case "unauthorized":
+    return 0x08, nil
+  }
+  return 0, errors.New("Invalid action " + action)
+}
+
+func parseNickPattern(pattern string) *regexp.Regexp {
+  if pattern == "" {
+    return nil
+  }
+  quoted := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+  return regexp.MustCompile("^" + quoted + "$")
+}
+
+func parsePolicyUUID(str string) (*UUID, error) {
+  if str == "" {
+    return nil, nil
+  }
+  uuid, err := ParseUUID(str)
+  if err != nil {
+    return nil, err
+  }
+  return &uuid, nil
+}
+
+func compilePolicy(policy *Policy) (*accessPolicy, error) {
+  result := &accessPolicy{make([]*policyRule, 0, len(policy.Rules)), 0}
+  var err error
+  if policy.Default != "" && policy.Default != "allow" &&
+     policy.Default != "deny" {
+    return nil, errors.New("Invalid default " + policy.Default)
+  }
+  if result.errorCode, err = parseAction(policy.Default); err != nil {
+    return nil, err
+  }
+
+  for _, rule := range policy.Rules {
+    r := &policyRule{parseNickPattern(rule.Client),
+      parseNickPattern(rule.Peripheral), rule.Uid, nil, nil, nil, 0}
+    if r.service, err = parsePolicyUUID(rule.Service); err != nil {
+      return nil, err
+    }
+    if r.characteristic, err = parsePolicyUUID(rule.Characteristic);
+       err != nil {
+      return nil, err
+    }
+    if len(rule.Access) > 0 {
+      r.access = make(map[Access]bool)
+      for _, name := range rule.Access {
+        access, ok := ACCESS_NAMES[name]
+        if !ok {
+          return nil, errors.New("Invalid access " + name)
+        }
+        r.access[access] = true
+      }
+    }
+    if r.errorCode, err = parseAction(rule.Action); err != nil {
+      return nil, err
+    }
+    result.rules = append(result.rules, r)
+  }
+  return result, nil
+}
+
+func matchNick(pattern *regexp.Regexp, nick string) bool {
+  return pattern == nil || pattern.MatchString(nick)
+}
+
+func (this *policyRule) matches(clientNick string, creds *Credentials,
+                                peripheralNick string, ctx *attributeContext,
+                                access Access) bool {
+  if !matchNick(this.client, clientNick) ||
+     !matchNick(this.peripheral, peripheralNick) {
+    return false
+  }
+  if this.uid != nil && (creds == nil || creds.Uid != *this.uid) {
+    return false
+  }
+  if this.service != nil && *this.service != ctx.service {
+    return false
+  }
+  if this.characteristic != nil &&
+     (!ctx.inCharacteristic || *this.characteristic != ctx.characteristic) {
+    return false
+  }
+  return this.access == nil || this.access[access]
+}
+
+// Returns the ATT error to deny an access with, or 0 if it is allowed.
+func (this *accessPolicy) check(clientNick string, creds *Credentials,
+                                peripheralNick string, ctx *attributeContext,
+                                access Access) uint8 {
+  errorCode := this.errorCode
+  for _, rule := range this.rules {
+    if rule.matches(clientNick, creds, peripheralNick, ctx, access) {
+      errorCode = rule.errorCode
+      break
+    }
+  }
+  if errorCode == 0x02 && access != ACCESS_READ {
+    // Write Not Permitted
+    errorCode = 0x03
+  }
+  return errorCode
+}
+
+// Returns the access a Read, Write or Write Command request performs.
+func accessOf(opcode uint8) Access {
+  switch opcode {
+  case ATT_OPCODE_WRITE_REQUEST:
+    return ACCESS_WRITE
+  case ATT_OPCODE_WRITE_COMMAND, ATT_OPCODE_SIGNED_WRITE_COMMAND:
+    return ACCESS_WRITE_NO_RESPONSE
+  }
+  return ACCESS_READ
+}
+
+// Returns the service and characteristic `handle` on `device` belongs to, or
+// nil if it isn't subject to policy. Declarations are always accessible so
+// that clients can discover the peripheral.
+func contextOf(device *Device, handle *Handle) *attributeContext {
+  switch handle.uuid {
+  case GATT_PRIMARY_SERVICE_UUID, GATT_SECONDARY_SERVICE_UUID,
+       GATT_INCLUDE_UUID, GATT_CHARACTERISTIC_UUID:
+    return nil
+  }
+  service := device.handles[handle.serviceHandle]
+  if service == nil {
+    return nil
+  }
+
+  ctx := &attributeContext{DecodeUUID(service.cachedValue), UUID{}, false}
+  // Value handles and descriptors point at their characteristic
+  // declaration, which points at the value handle
+  if decl := device.handles[handle.charHandle]; decl != nil &&
+     decl.uuid == GATT_CHARACTERISTIC_UUID {
+    if value := device.handles[decl.charHandle]; value != nil {
+      ctx.characteristic = value.uuid
+      ctx.inCharacteristic = true
+    }
+  }
+  return ctx
+}
+
+// Returns the ATT error to deny `client` an access to `handle` on `peripheral`
+// with, or 0 if the manager's policy allows it.
+func (this *Manager) checkAccess(client, peripheral *Device, handle *Handle,
+                                 access Access) uint8 {
+  if this.policy == nil || peripheral == this.local {
+    return 0
+  }
+  ctx := contextOf(peripheral, handle)
+  if ctx == nil {
+    return 0
+  }
+  return this.policy.check(client.nick, client.creds, peripheral.nick, ctx,
+    access)
+}
+
+// Installs an access control policy, or allows every access if `policy` is
+// nil.
+func (this *Manager) SetPolicy(policy *Policy) error {
+  var compiled *accessPolicy
+  if policy != nil {
+    var err error
+    if compiled, err = compilePolicy(policy); err != nil {
+      return err
+    }
+  }
+  this.do(func() {
+    this.policy = compiled
+    this.policyFile = ""
+  })
+  return nil
+}
+
+// Reads an access control policy from a JSON file and installs it. The
+// current policy is kept if the file is invalid.
+func (this *Manager) LoadPolicy(file string) error {
+  buf, err := ioutil.ReadFile(file)
+  if err != nil {
+    return err
+  }
+  var policy Policy
+  if err := json.Unmarshal(buf, &policy); err != nil {
+    return err
+  }
+  compiled, err := compilePolicy(&policy)
+  if err != nil {
+    return err
+  }
+  this.do(func() {
+    this.policy = compiled
+    this.policyFile = file
+  })
+  return nil
+}
+
+// Reads the policy file last loaded with LoadPolicy again.
+func (this *Manager) ReloadPolicy() error {
+  var file string
+  this.do(func() {
+    file = this.policyFile
+  })
+  if file == "" {
+    return errors.New("No policy file loaded")
+  }
+  return this.LoadPolicy(file)
+}
@@ -0,0 +1,139 @@
+package ble
+
+import (
+  "fmt"
+  "io"
+  "time"
+)
+
+// How often to retry connecting to a peripheral whose link dropped
+const DEFAULT_RECONNECT_INTERVAL = 5 * time.Second
+
+type restoredLink struct {
+  device   *Device
+  fd       io.ReadWriteCloser
+  connInfo *ConnInfo
+}
+
+// Returns the nickname of a device, or "" if it is no longer managed.
+func (this *Manager) nickOf(device *Device) string {
+  for nick, d := range this.devices {
+    if d == device {
+      return nick
+    }
+  }
+  return ""
+}
+
+// Handles a dropped link. Devices that can be redialed keep their handles,
+// handle ranges and subscriptions while Beetle periodically tries to reconnect;
+// requests to them fail in the meantime. Other devices (e.g. clients that
+// connected to Beetle) are removed.
+//
+// Clients the peripheral is served to are sent a Service Changed indication
+// over its range when the link drops, so they know its attributes are gone,
+// and again when it is back, since anything they discovered in between is
+// incomplete.
+func (this *Manager) handleLinkLoss(device *Device) {
+  nick := this.nickOf(device)
+  if nick == "" {
+    return
+  }
+  if Debug {
+    fmt.Printf("%s: link lost\n", device.addr)
+  }
+
+  if device.redial == nil {
+    this.removeDevice(nick, device)
+    return
+  }
+
+  this.cancelPreparedWrites(device)
+  if client := device.prepareOwner; client != nil {
+    client.prepareQueue = nil
+    device.prepareOwner = nil
+  }
+  this.dropIndications(device, nil)
+  this.servedRangesChanged(device)
+
+  go this.redial(device)
+}
+
+func (this *Manager) redial(device *Device) {
+  for {
+    select {
+    case <-device.done:
+      return
+    case <-time.After(this.ReconnectInterval):
+    }
+
+    fd, ci, err := device.redial()
+    if err != nil {
+      if Debug {
+        fmt.Printf("%s: reconnect failed: %s\n", device.addr, err)
+      }
+      continue
+    }
+    this.linkRestored <-&restoredLink{device, fd, ci}
+    return
+  }
+}
+
+// Resumes using a reconnected peripheral with its cached handles, then
+// renegotiates the MTU and restores client configurations for characteristics
+// that still have subscribers. Unless its Database Hash shows the cached
+// handles are still current, the peripheral is rediscovered first.
+func (this *Manager) restoreLink(link *restoredLink) {
+  device := link.device
+  if this.nickOf(device) == "" {
+    link.fd.Close()
+    return
+  }
+  device.reconnect(link.fd, link.connInfo)
+  if Debug {
+    fmt.Printf("%s: reconnected\n", device.addr)
+  }
+  this.servedRangesChanged(device)
+
+  go func() {
+    mtu, err := ExchangeMTU(device, ATT_MAX_MTU)
+    if err != nil {
+      return
+    }
+    this.do(func() {
+      device.mtu = mtu
+    })
+
+    // The peripheral's database may have changed while it was away, and
+    // applying the rediscovered handles restores the configurations
+    if cache := this.readCache(device); cache == nil ||
+       !this.cacheCurrent(device, cache) {
+      if Debug {
+        fmt.Printf("%s: database may have changed, rediscovering\n",
+          device.addr)
+      }
+      this.queueRediscovery(device)
+      return
+    }
+    this.do(func() {
+      this.restoreSubscriptions(device)
+    })
+  }()
+}
+
+// Writes the union of each characteristic's subscriber configurations to the
+// peripheral's client characteristic configuration descriptor.
+func (this *Manager) restoreSubscriptions(device *Device) {
+  for _, handle := range device.sorted {
+    value := handle.effectiveCCCD()
+    cccd := device.cccdFor(handle)
+    if value == 0 || cccd == nil {
+      continue
+    }
+    h := cccd.handle
+    device.Transaction(
+      []byte{ATT_OPCODE_WRITE_REQUEST, byte(h & 0xff), byte(h >> 8),
+             byte(value & 0xff), byte(value >> 8)},
+      func(resp []byte, err error){})
+  }
+}
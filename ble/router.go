@@ -3,12 +3,16 @@ package ble
 import (
   "bytes"
   "time"
-  "sort"
 )
 
 func (this *Manager) RouteConnUpdate(req Request) {
+  if len(req.msg) < 3 {
+    resp := NewError(ATT_OPCODE_CONN_UPDATE, 0, 4)
+    req.device.Respond(resp.msg)
+    return
+  }
   interval := uint16(req.msg[1]) + uint16(req.msg[2]) << 8
-  for _,device := range(this.Devices) {
+  for _,device := range(this.devices) {
     if device != req.device {
       this.ConnUpdate(device, interval)
     }
@@ -18,6 +22,19 @@ func (this *Manager) RouteConnUpdate(req Request) {
   req.device.Respond(msg)
 }
 
+func (this *Manager) RouteMTU(req Request) {
+  mtuReq, err := ParseMTURequest(req.msg)
+  if err != nil {
+    resp := NewError(ATT_OPCODE_MTU_REQUEST, 0, 4)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  resp := NewMTUResponse(ATT_MAX_MTU)
+  req.device.Respond(resp.msg)
+  req.device.mtu = NegotiateMTU(mtuReq.MTU())
+}
+
 func (this *Manager) RouteFindInfo(req Request) {
   findReq, err := ParseFindInfoRequest(req.msg)
   if err != nil {
@@ -29,31 +46,14 @@ func (this *Manager) RouteFindInfo(req Request) {
     endHandle := findReq.EndHandle()
 
     handles := make(HandleUUIDLst, 0, 10)
-    for _, device := range this.Devices {
-      offset := uint16(device.handleOffset)
-
-      if device == req.device || device.handleOffset < 0 ||
-        offset + uint16(len(device.handles)) < startHandle {
-        continue
-      }
-      if device.handleOffset > int(endHandle) {
-        break
-      }
-
-      for _, handle := range device.handles {
-        if handle.handle + offset >= startHandle &&
-            handle.handle + offset <= endHandle {
-          h := HandleUUID{handle.handle + offset, handle.uuid}
-          h.handle += offset
-          handles = append(handles, h)
-        }
-      }
-    }
-
-    sort.Sort(handles)
+    req.device.eachHandle(startHandle, endHandle,
+      func(r *HandleRange, handle *Handle) {
+        handles = append(handles,
+          HandleUUID{handle.handle + r.offset, handle.uuid})
+      })
 
     if len(handles) > 0 {
-      resp := NewFindInfoResponse(handles)
+      resp := NewFindInfoResponse(handles, req.device.mtu)
       req.device.Respond(resp.msg)
     } else {
       resp := NewError(ATT_OPCODE_FIND_INFO_REQUEST, startHandle, 0x0A)
@@ -76,31 +76,19 @@ func (this *Manager) RouteFindByTypeValue(req Request) {
     attVal := findReq.Value()
 
     handles := make(GroupValueLst, 0, 10)
-    for _,device := range this.Devices {
-      offset := uint16(device.handleOffset)
-
-      if device == req.device || device.handleOffset < 0 ||
-        offset + uint16(len(device.handles)) < startHandle {
-        continue
-      }
-      if offset > endHandle {
-        break
-      }
-
-      for _, handle := range device.handles {
-        if handle.handle + offset >= startHandle &&
-            handle.handle + offset <= endHandle &&
-            handle.uuid == attType && bytes.Equal(handle.cachedValue, attVal) {
-          h := &GroupValue{handle.handle + offset, handle.endGroup + offset, nil}
-          handles = append(handles, h)
+    req.device.eachHandle(startHandle, endHandle,
+      func(r *HandleRange, handle *Handle) {
+        // Matching a value reads it, so values the client may not read
+        // aren't matched
+        if handle.uuid == attType && bytes.Equal(handle.cachedValue, attVal) &&
+           this.checkAccess(req.device, r.device, handle, ACCESS_READ) == 0 {
+          handles = append(handles, &GroupValue{handle.handle + r.offset,
+            r.toClient(handle.endGroup), nil})
         }
-      }
-    }
-
-    sort.Sort(handles)
+      })
 
     if len(handles) > 0 {
-      resp := NewFindByTypeValueResponse(handles)
+      resp := NewFindByTypeValueResponse(handles, req.device.mtu)
       req.device.Respond(resp.msg)
     } else {
       resp := NewError(ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST, startHandle, 0x0A)
@@ -109,6 +97,50 @@ func (this *Manager) RouteFindByTypeValue(req Request) {
   }
 }
 
+// Answers Read By Group Type requests (i.e. service discovery) from the
+// service declarations cached by StartDevice.
+func (this *Manager) RouteReadByGroupType(req Request) {
+  readReq, err := ParseReadByGroupTypeRequest(req.msg)
+  if err != nil {
+    resp := NewError(ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST, 0, 4)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  startHandle := readReq.StartHandle()
+  endHandle := readReq.EndHandle()
+  attType := readReq.Type()
+
+  if startHandle == 0 || startHandle > endHandle {
+    resp := NewError(ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST, startHandle, 0x01)
+    req.device.Respond(resp.msg)
+    return
+  }
+  if attType != GATT_PRIMARY_SERVICE_UUID &&
+     attType != GATT_SECONDARY_SERVICE_UUID {
+    resp := NewError(ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST, startHandle, 0x10)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  handles := make(GroupValueLst, 0, 10)
+  req.device.eachHandle(startHandle, endHandle,
+    func(r *HandleRange, handle *Handle) {
+      if handle.uuid == attType {
+        handles = append(handles, &GroupValue{handle.handle + r.offset,
+          r.toClient(handle.endGroup), handle.cachedValue})
+      }
+    })
+
+  if len(handles) > 0 {
+    resp := NewReadByGroupTypeResponse(handles, req.device.mtu)
+    req.device.Respond(resp.msg)
+  } else {
+    resp := NewError(ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST, startHandle, 0x0A)
+    req.device.Respond(resp.msg)
+  }
+}
+
 func (this *Manager) RouteReadByType(req Request) {
   readReq, err := ParseReadByTypeRequest(req.msg)
   if err != nil {
@@ -121,175 +153,664 @@ func (this *Manager) RouteReadByType(req Request) {
   endHandle := readReq.EndHandle()
   attType := readReq.Type()
 
+  this.readByTypeFrom(req, req.device.rangeIndex(startHandle), startHandle,
+    endHandle, attType)
+}
 
-  for _,device := range this.Devices {
-    if (device == req.device) {
-      continue
+// Forwards a Read By Type request to the `i`th mapped range, the first at or
+// after `startHandle`, moving on to the next range if the peripheral has no
+// matching attributes.
+func (this *Manager) readByTypeFrom(req Request, i int,
+                                    startHandle, endHandle uint16, attType UUID) {
+  ranges := req.device.ranges
+  if i >= len(ranges) || ranges[i].offset >= endHandle {
+    req.device.Respond(
+      NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, startHandle, 0x0A).msg)
+    return
+  }
+
+  r := ranges[i]
+  offset := r.offset
+  remoteStart := uint16(1)
+  if startHandle > offset {
+    remoteStart = startHandle - offset
+  }
+  remoteEnd := r.device.highestHandle
+  if endHandle < r.end {
+    remoteEnd = endHandle - offset
+  }
+
+  remoteReq := NewReadByTypeRequest(remoteStart, remoteEnd, attType)
+  this.transaction(r.device, remoteReq.msg, func(respBuf []byte, err error) {
+    if err != nil {
+      resp := NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, startHandle, 0x0E)
+      req.device.Respond(resp.msg)
+      return
+    }
+    if respBuf[0] == ATT_OPCODE_ERROR {
+      if isNotFound(respBuf, ATT_OPCODE_READ_BY_TYPE_REQUEST) &&
+         r.end < endHandle {
+        this.readByTypeFrom(req, i + 1, r.end + 1, endHandle, attType)
+        return
+      }
+      req.device.Respond(r.responseToClient(ATT_OPCODE_READ_BY_TYPE_REQUEST,
+        startHandle, respBuf))
+      return
     }
-    offset := uint16(device.handleOffset)
-    if startHandle >= offset + 1 &&
-       startHandle <= offset + uint16(len(device.handles)) {
-      remoteReq := NewReadByTypeRequest(startHandle - offset,
-                    endHandle - offset, attType)
-      device.Transaction(remoteReq.msg, func(respBuf []byte, err error) {
-        if err != nil {
-          resp := NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, 0, 4)
+
+    readResp, err := ParseReadByTypeResponse(respBuf)
+    // Characteristic declarations hold the value handle after the properties
+    if respBuf[0] != ATT_OPCODE_READ_BY_TYPE_RESPONSE || err != nil ||
+       (attType == GATT_CHARACTERISTIC_UUID && readResp.Length() < 5) {
+      resp := NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, startHandle, 0x0E)
+      req.device.Respond(resp.msg)
+    } else {
+      segLen := int(readResp.Length())
+      // Stop short of the first attribute the client may not read
+      for i := 2; i < len(respBuf); i += segLen {
+        h := uint16(respBuf[i]) + uint16(respBuf[i + 1]) << 8
+        handle := r.device.handles[h]
+        if handle == nil {
+          continue
+        }
+        code := this.checkAccess(req.device, r.device, handle, ACCESS_READ)
+        if code != 0 && i == 2 {
+          this.audit(req.device, r.device, handle,
+            ATT_OPCODE_READ_BY_TYPE_REQUEST, nil, "denied", code)
+          resp := NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, h + offset, code)
           req.device.Respond(resp.msg)
           return
+        } else if code != 0 {
+          respBuf = respBuf[:i]
+          break
         }
-        if respBuf[0] == ATT_OPCODE_ERROR {
-          resp := NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, startHandle, 0x0A)
-          req.device.Respond(resp.msg)
-        } else {
-          segLen := int(respBuf[1])
-          for i := 2; i < len(respBuf); i += segLen {
-            h := uint16(respBuf[i]) + uint16(respBuf[i + 1]) << 8
-            h += offset
-            respBuf[i] = byte(h & 0xff)
-            respBuf[i + 1] = byte(h >> 8)
-
-            if attType == GATT_CHARACTERISTIC_UUID {
-              j := i + 3
-              value_handle := uint16(respBuf[j]) + uint16(respBuf[j + 1]) << 8
-              value_handle += offset
-              respBuf[j] = byte(value_handle & 0xff)
-              respBuf[j + 1] = byte(value_handle >> 8)
-            }
-          }
-          req.device.Respond(respBuf)
+      }
+
+      for i := 2; i < len(respBuf); i += segLen {
+        h := uint16(respBuf[i]) + uint16(respBuf[i + 1]) << 8
+        h += offset
+        respBuf[i] = byte(h & 0xff)
+        respBuf[i + 1] = byte(h >> 8)
+
+        if attType == GATT_CHARACTERISTIC_UUID {
+          j := i + 3
+          value_handle := uint16(respBuf[j]) + uint16(respBuf[j + 1]) << 8
+          value_handle += offset
+          respBuf[j] = byte(value_handle & 0xff)
+          respBuf[j + 1] = byte(value_handle >> 8)
         }
-      })
+      }
+      respBuf = FitToMTU(respBuf, req.device.mtu)
+      // Truncating a lone entry shortens it
+      segLen = int(respBuf[1])
+
+      for i := 2; i + segLen <= len(respBuf); i += segLen {
+        h := uint16(respBuf[i]) + uint16(respBuf[i + 1]) << 8 - offset
+        if handle := r.device.handles[h]; handle != nil {
+          this.audit(req.device, r.device, handle,
+            ATT_OPCODE_READ_BY_TYPE_REQUEST, respBuf[i + 2:i + segLen], "ok", 0)
+        }
+      }
+      req.device.Respond(respBuf)
+    }
+  })
+}
+
+// A run of consecutive handles in a Read Multiple request that live on the
+// same peripheral
+type readRun struct {
+  r       *HandleRange
+  handles []uint16
+  resp    []byte
+  err     error
+}
+
+// Splits a Read Multiple request into runs of consecutive handles on the same
+// peripheral, reads the runs in parallel and reassembles the values in the
+// order requested.
+func (this *Manager) RouteReadMultiple(req Request) {
+  readReq, err := ParseReadMultipleRequest(req.msg)
+  if err != nil {
+    resp := NewError(ATT_OPCODE_READ_MULTIPLE_REQUEST, 0, 4)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  runs := make([]*readRun, 0, 2)
+  for _, handle := range readReq.Handles() {
+    r := req.device.rangeFor(handle)
+    if r == nil || r.device.handles[handle - r.offset] == nil {
+      resp := NewError(ATT_OPCODE_READ_MULTIPLE_REQUEST, handle, 0x01)
+      req.device.Respond(resp.msg)
       return
     }
+    code := this.checkAccess(req.device, r.device,
+      r.device.handles[handle - r.offset], ACCESS_READ)
+    if code != 0 {
+      this.audit(req.device, r.device, r.device.handles[handle - r.offset],
+        ATT_OPCODE_READ_MULTIPLE_REQUEST, nil, "denied", code)
+      resp := NewError(ATT_OPCODE_READ_MULTIPLE_REQUEST, handle, code)
+      req.device.Respond(resp.msg)
+      return
+    }
+    if len(runs) > 0 && runs[len(runs) - 1].r == r {
+      run := runs[len(runs) - 1]
+      run.handles = append(run.handles, handle)
+    } else {
+      runs = append(runs, &readRun{r, []uint16{handle}, nil, nil})
+    }
+  }
+
+  pending := len(runs)
+  for _, run := range runs {
+    remoteHandles := make([]uint16, len(run.handles))
+    for i, handle := range run.handles {
+      remoteHandles[i] = handle - run.r.offset
+    }
+
+    var pkt []byte
+    if len(remoteHandles) == 1 {
+      h := remoteHandles[0]
+      pkt = []byte{ATT_OPCODE_READ_REQUEST, byte(h & 0xff), byte(h >> 8)}
+    } else {
+      pkt = NewReadMultipleRequest(remoteHandles).msg
+    }
+
+    run := run
+    this.transaction(run.r.device, pkt, func(resp []byte, err error) {
+      // Values read together can't be told apart, so only results are
+      // recorded
+      for _, handle := range run.handles {
+        this.auditResponse(req.device, run.r.device,
+          run.r.device.handles[handle - run.r.offset],
+          ATT_OPCODE_READ_MULTIPLE_REQUEST, nil, resp, err)
+      }
+      run.resp = resp
+      run.err = err
+      pending--
+      if pending == 0 {
+        this.finishReadMultiple(req, runs)
+      }
+    })
+  }
+}
+
+// Responds to a Read Multiple request once every run has been read.
+func (this *Manager) finishReadMultiple(req Request, runs []*readRun) {
+  result := []byte{ATT_OPCODE_READ_MULTIPLE_RESPONSE}
+  for _, run := range runs {
+    if run.err != nil {
+      resp := NewError(ATT_OPCODE_READ_MULTIPLE_REQUEST, run.handles[0], 0x0E)
+      req.device.Respond(resp.msg)
+      return
+    }
+    if run.resp[0] == ATT_OPCODE_ERROR {
+      resp := run.r.responseToClient(ATT_OPCODE_READ_MULTIPLE_REQUEST,
+        run.handles[0], run.resp)
+      resp[1] = ATT_OPCODE_READ_MULTIPLE_REQUEST
+      req.device.Respond(resp)
+      return
+    }
+    // Runs of one handle are read with a Read Request
+    expected := ATT_OPCODE_READ_MULTIPLE_RESPONSE
+    if len(run.handles) == 1 {
+      expected = ATT_OPCODE_READ_RESPONSE
+    }
+    if run.resp[0] != expected {
+      resp := NewError(ATT_OPCODE_READ_MULTIPLE_REQUEST, run.handles[0], 0x0E)
+      req.device.Respond(resp.msg)
+      return
+    }
+    result = append(result, run.resp[1:]...)
+  }
+  req.device.Respond(FitToMTU(result, req.device.mtu))
+}
+
+// Forwards a Prepare Write request to the owning peripheral. A client's queue
+// may only target a single peripheral, and a peripheral's queue may only hold
+// writes from a single client, so that executing the queue is atomic.
+func (this *Manager) RoutePrepareWrite(req Request) {
+  prepReq, err := ParsePrepareWriteRequest(req.msg)
+  if err != nil {
+    resp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, 0, 4)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  handleNum := prepReq.Handle()
+  r := req.device.rangeFor(handleNum)
+  if r == nil || r.device.handles[handleNum - r.offset] == nil {
+    resp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, 0x01)
+    req.device.Respond(resp.msg)
+    return
+  }
+  device := r.device
+  handle := device.handles[handleNum - r.offset]
+
+  // Configurations are only updated by Write Requests
+  if handle.uuid == GATT_CLIENT_CONFIGURATION_UUID {
+    resp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, 0x06)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  code := this.checkAccess(req.device, device, handle, ACCESS_WRITE)
+  if code != 0 {
+    this.audit(req.device, device, handle, ATT_OPCODE_PREPARE_WRITE_REQUEST,
+      prepReq.Value(), "denied", code)
+    resp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, code)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  if (req.device.prepareQueue != nil && req.device.prepareQueue != device) ||
+     (device.prepareOwner != nil && device.prepareOwner != req.device) {
+    resp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, 0x09)
+    req.device.Respond(resp.msg)
+    return
+  }
+  if len(req.msg) > int(device.mtu) {
+    resp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, 0x0D)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  req.device.prepareQueue = device
+  device.prepareOwner = req.device
+
+  remoteHandle := handleNum - r.offset
+  pkt := make([]byte, len(req.msg))
+  copy(pkt, req.msg)
+  pkt[1] = byte(remoteHandle & 0xff)
+  pkt[2] = byte(remoteHandle >> 8)
+
+  this.transaction(device, pkt, func(resp []byte, err error) {
+    this.auditResponse(req.device, device, handle,
+      ATT_OPCODE_PREPARE_WRITE_REQUEST, prepReq.Value(), resp, err)
+    if err != nil {
+      errResp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, 0x0E)
+      req.device.Respond(errResp.msg)
+    } else if resp[0] == ATT_OPCODE_PREPARE_WRITE_RESPONSE && len(resp) >= 5 {
+      // Echoed handle is the peripheral's
+      resp[1] = byte(handleNum & 0xff)
+      resp[2] = byte(handleNum >> 8)
+      req.device.Respond(resp)
+    } else if resp[0] == ATT_OPCODE_PREPARE_WRITE_RESPONSE {
+      errResp := NewError(ATT_OPCODE_PREPARE_WRITE_REQUEST, handleNum, 0x0E)
+      req.device.Respond(errResp.msg)
+    } else {
+      req.device.Respond(r.responseToClient(ATT_OPCODE_PREPARE_WRITE_REQUEST,
+        handleNum, resp))
+    }
+  })
+}
+
+// Executes or cancels the client's queued prepared writes on the peripheral
+// holding them.
+func (this *Manager) RouteExecuteWrite(req Request) {
+  execReq, err := ParseExecuteWriteRequest(req.msg)
+  if err != nil {
+    resp := NewError(ATT_OPCODE_EXECUTE_WRITE_REQUEST, 0, 4)
+    req.device.Respond(resp.msg)
+    return
+  }
+
+  device := req.device.prepareQueue
+  if device == nil {
+    req.device.Respond([]byte{ATT_OPCODE_EXECUTE_WRITE_RESPONSE})
+    return
   }
-  req.device.Respond(NewError(ATT_OPCODE_READ_BY_TYPE_REQUEST, 0, 0x0A).msg)
+  req.device.prepareQueue = nil
+  device.prepareOwner = nil
+
+  r := req.device.rangeOf(device)
+  this.transaction(device, NewExecuteWriteRequest(execReq.Flags()).msg,
+    func(resp []byte, err error) {
+      if execReq.Flags() == ATT_EXECUTE_WRITE_COMMIT {
+        this.auditResponse(req.device, device, nil,
+          ATT_OPCODE_EXECUTE_WRITE_REQUEST, nil, resp, err)
+      }
+      if err != nil {
+        errResp := NewError(ATT_OPCODE_EXECUTE_WRITE_REQUEST, 0, 0x0E)
+        req.device.Respond(errResp.msg)
+      } else if r != nil {
+        req.device.Respond(r.responseToClient(ATT_OPCODE_EXECUTE_WRITE_REQUEST,
+          0, resp))
+      } else if resp[0] == ATT_OPCODE_EXECUTE_WRITE_RESPONSE {
+        req.device.Respond(resp)
+      } else {
+        errResp := NewError(ATT_OPCODE_EXECUTE_WRITE_REQUEST, 0, 0x0E)
+        req.device.Respond(errResp.msg)
+      }
+    })
+}
+
+// Discards any prepared writes queued by `client`, e.g. when it disconnects or
+// loses access to the peripheral holding them.
+func (this *Manager) cancelPreparedWrites(client *Device) {
+  device := client.prepareQueue
+  if device == nil {
+    return
+  }
+  client.prepareQueue = nil
+  device.prepareOwner = nil
+  device.Transaction(NewExecuteWriteRequest(ATT_EXECUTE_WRITE_CANCEL).msg,
+    func(resp []byte, err error) {})
 }
 
+// Runs `f` on the router goroutine and waits for it to return. Must not be
+// called from the router goroutine itself.
+func (this *Manager) do(f func()) {
+  done := make(chan struct{})
+  this.calls <- func() {
+    f()
+    close(done)
+  }
+  <-done
+}
+
+// Like Device.Transaction, but runs `cb` on the router goroutine so that it
+// may use the manager's state.
+func (this *Manager) transaction(device *Device, pkt []byte,
+                                 cb func([]byte, error)) {
+  device.Transaction(pkt, func(resp []byte, err error) {
+    this.calls <- func() {
+      cb(resp, err)
+    }
+  })
+}
+
+// Routes requests and runs the manager's state changes until the request
+// channel is closed. All of the manager's state is owned by this goroutine.
 func (this *Manager) RunRouter() {
+  for {
+    select {
+    case f := <-this.calls:
+      f()
+    case q := <-this.indicationTimeouts:
+      this.timeoutIndication(q)
+    case device := <-this.linkLost:
+      this.handleLinkLoss(device)
+    case link := <-this.linkRestored:
+      this.restoreLink(link)
+    case d := <-this.discovered:
+      this.applyDiscovery(d.device, d.handles)
+    case req, ok := <-this.requestChan:
+      if !ok {
+        return
+      }
+      this.route(req)
+    }
+  }
+}
+
+func (this *Manager) route(req Request) {
   //interval := uint16(6)
-  for req := range this.requestChan {
-    pkt := req.msg
-    switch(pkt[0]) {
-    case ATT_OPCODE_CONN_UPDATE:
-      this.RouteConnUpdate(req)
-    case ATT_OPCODE_FIND_INFO_REQUEST:
-      this.RouteFindInfo(req)
-    case ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST:
-      this.RouteFindByTypeValue(req)
-    case ATT_OPCODE_READ_BY_TYPE_REQUEST:
-      go this.RouteReadByType(req)
-
-    case ATT_OPCODE_HANDLE_VALUE_NOTIFICATION:
-      handleNum := uint16(pkt[1]) + uint16(pkt[2]) << 8
-      device := req.device
-
-      proxyHandle := device.handles[handleNum]
-
-      if proxyHandle == nil {
+  pkt := req.msg
+  switch(pkt[0]) {
+  case ATT_OPCODE_CONN_UPDATE:
+    this.RouteConnUpdate(req)
+  case ATT_OPCODE_MTU_REQUEST:
+    this.RouteMTU(req)
+  case ATT_OPCODE_FIND_INFO_REQUEST:
+    this.RouteFindInfo(req)
+  case ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST:
+    this.RouteFindByTypeValue(req)
+  case ATT_OPCODE_READ_BY_TYPE_REQUEST:
+    this.RouteReadByType(req)
+  case ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST:
+    this.RouteReadByGroupType(req)
+  case ATT_OPCODE_READ_MULTIPLE_REQUEST:
+    this.RouteReadMultiple(req)
+  case ATT_OPCODE_PREPARE_WRITE_REQUEST:
+    this.RoutePrepareWrite(req)
+  case ATT_OPCODE_EXECUTE_WRITE_REQUEST:
+    this.RouteExecuteWrite(req)
+
+  case ATT_OPCODE_HANDLE_VALUE_INDICATION:
+    update, err := ParseHandleValueUpdate(pkt)
+    if err != nil {
+      // Nothing to fan out, but the peripheral still awaits a confirmation
+      req.device.WriteCmd([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+      return
+    }
+    proxyHandle := req.device.handles[update.Handle()]
+
+    if proxyHandle == nil {
+      req.device.WriteCmd([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+      return
+    }
+    if proxyHandle.uuid == GATT_SERVICE_CHANGED_UUID {
+      this.peripheralServiceChanged(req.device)
+      return
+    }
+    this.indicate(req.device, proxyHandle, pkt)
+  case ATT_OPCODE_HANDLE_VALUE_CONFIRMATION:
+    this.confirmIndication(req.device)
+
+  case ATT_OPCODE_HANDLE_VALUE_NOTIFICATION:
+    update, err := ParseHandleValueUpdate(pkt)
+    if err != nil {
+      return
+    }
+    handleNum := update.Handle()
+    device := req.device
+
+    proxyHandle := device.handles[handleNum]
+
+    if proxyHandle == nil {
+      return
+    }
+
+    for dev, cccd := range proxyHandle.subscribers {
+      if cccd & GATT_CCCD_NOTIFY == 0 ||
+         this.checkAccess(dev, device, proxyHandle, ACCESS_SUBSCRIBE) != 0 {
         continue
       }
+      r := dev.rangeOf(device)
+      if r == nil {
+        continue
+      }
+      clientHandle := r.toClient(handleNum)
+      clientPkt := make([]byte, len(pkt))
+      copy(clientPkt, pkt)
+      clientPkt = FitToMTU(clientPkt, dev.mtu)
+      clientPkt[1] = byte(clientHandle & 0xff)
+      clientPkt[2] = byte(clientHandle >> 8)
+      dev.WriteCmd(clientPkt)
+    }
+  case ATT_OPCODE_READ_REQUEST:
+    fallthrough
+  case ATT_OPCODE_READ_BLOB_REQUEST:
+    fallthrough
+  case ATT_OPCODE_WRITE_REQUEST:
+    fallthrough
+  case ATT_OPCODE_WRITE_COMMAND:
+    fallthrough
+  case ATT_OPCODE_SIGNED_WRITE_COMMAND:
+    opcode := pkt[0]
+    handleReq, err := ParseHandleRequest(pkt)
+    if err != nil {
+      if opcode != ATT_OPCODE_WRITE_COMMAND &&
+         opcode != ATT_OPCODE_SIGNED_WRITE_COMMAND {
+        resp := NewError(opcode, 0, 4)
+        req.device.Respond(resp.msg)
+      }
+      return
+    }
+    handleNum := handleReq.Handle()
 
-      remoteHandle := handleNum + uint16(device.handleOffset)
-      pkt[1] = byte(remoteHandle & 0xff)
-      pkt[2] = byte(remoteHandle >> 8)
+    r := req.device.rangeFor(handleNum)
+    if r == nil {
+      resp := NewError(pkt[0], handleNum, 0x1)
+      req.device.Respond(resp.msg)
+      return
+    }
 
-      for dev,_ := range proxyHandle.subscribers {
-        dev.WriteCmd(pkt)
-      }
-    case ATT_OPCODE_READ_REQUEST:
-      fallthrough
-    case ATT_OPCODE_READ_BLOB_REQUEST:
-      fallthrough
-    case ATT_OPCODE_WRITE_REQUEST:
-      fallthrough
-    case ATT_OPCODE_WRITE_COMMAND:
-      fallthrough
+    device := r.device
+    remoteHandle := handleNum - r.offset
+    proxyHandle := device.handles[remoteHandle]
+
+    if proxyHandle == nil {
+      resp := NewError(pkt[0], handleNum, 0x1)
+      req.device.Respond(resp.msg)
+      return
+    }
+
+    // Configurations are the union of every subscriber's, kept below, which
+    // only Write Requests update since a failed write must be undone
+    if proxyHandle.uuid == GATT_CLIENT_CONFIGURATION_UUID &&
+       (opcode == ATT_OPCODE_WRITE_COMMAND ||
+        opcode == ATT_OPCODE_SIGNED_WRITE_COMMAND) {
+      return
+    }
+
+    // Copied as the packet is rewritten for the peripheral
+    var value []byte
+    switch opcode {
+    case ATT_OPCODE_WRITE_REQUEST, ATT_OPCODE_WRITE_COMMAND:
+      value = append([]byte{}, handleReq.Value()...)
     case ATT_OPCODE_SIGNED_WRITE_COMMAND:
-      handleNum := uint16(pkt[1]) + uint16(pkt[2]) << 8
+      // Without the signature
+      value = append([]byte{}, pkt[3:len(pkt) - 12]...)
+    }
 
-      var device *Device
-      for _,d := range this.Devices {
-        if d.handleOffset < int(handleNum) &&
-          d.highestHandle >= int(handleNum) {
-          device = d
-          break
+    // Subscriptions are checked once the configuration is parsed below
+    if opcode != ATT_OPCODE_WRITE_REQUEST ||
+       proxyHandle.uuid != GATT_CLIENT_CONFIGURATION_UUID {
+      code := this.checkAccess(req.device, device, proxyHandle,
+        accessOf(opcode))
+      if code != 0 {
+        this.audit(req.device, device, proxyHandle, opcode, value, "denied",
+          code)
+        if opcode != ATT_OPCODE_WRITE_COMMAND &&
+           opcode != ATT_OPCODE_SIGNED_WRITE_COMMAND {
+          resp := NewError(opcode, handleNum, code)
+          req.device.Respond(resp.msg)
         }
+        return
       }
-      if device == nil {
-        resp := NewError(pkt[0], handleNum, 0x1)
+    }
+
+    if len(pkt) > int(device.mtu) {
+      // The peripheral's MTU is smaller than the client's
+      if pkt[0] != ATT_OPCODE_WRITE_COMMAND &&
+         pkt[0] != ATT_OPCODE_SIGNED_WRITE_COMMAND {
+        resp := NewError(pkt[0], handleNum, 0x0D)
         req.device.Respond(resp.msg)
-        continue
       }
+      return
+    }
 
-      remoteHandle := handleNum - uint16(device.handleOffset)
-      proxyHandle := device.handles[remoteHandle]
-
-      if proxyHandle == nil {
-        resp := NewError(pkt[0], handleNum, 0x1)
+    if pkt[0] == ATT_OPCODE_WRITE_REQUEST &&
+       proxyHandle.uuid == GATT_CLIENT_CONFIGURATION_UUID {
+      if len(pkt) != 5 {
+        resp := NewError(pkt[0], handleNum, 0x0D)
         req.device.Respond(resp.msg)
-        continue
+        return
       }
-
-      if pkt[0] == ATT_OPCODE_WRITE_REQUEST &&
-         proxyHandle.uuid == GATT_CLIENT_CONFIGURATION_UUID {
-        proxyCharHandle := device.handles[proxyHandle.charHandle]
+      proxyCharHandle := device.handles[proxyHandle.charHandle]
+      if proxyCharHandle != nil {
         proxyCharHandle = device.handles[proxyCharHandle.charHandle]
-        if pkt[3] == 0 {
-          delete(proxyCharHandle.subscribers, req.device)
-        } else {
-          proxyCharHandle.subscribers[req.device] = true
-        }
-        numSubscribers := len(proxyCharHandle.subscribers)
-        if numSubscribers == 0 && pkt[3] == 0 ||
-           numSubscribers == 1 && pkt[3] == 1 {
-          // First subscribe or last unsubscribe case
-          // Translate packet handle with sutracted device offset
-          pkt[1] = byte(remoteHandle & 0xff)
-          pkt[2] = byte(remoteHandle >> 8)
-
-          device.Transaction(pkt, func(resp []byte, err error) {
-            if err != nil {
-              errResp := NewError(pkt[1], handleNum, 0x0E)
-              req.device.Respond(errResp.msg)
-            } else {
-              req.device.Respond(resp)
-            }
-          })
-        } else {
-          req.device.Respond([]byte{ATT_OPCODE_WRITE_RESPONSE})
+      }
+      if proxyCharHandle == nil {
+        // A descriptor outside any discovered characteristic
+        resp := NewError(pkt[0], handleNum, 0x0E)
+        req.device.Respond(resp.msg)
+        return
+      }
+
+      cccd := uint16(value[0]) | uint16(value[1]) << 8
+      if cccd != 0 {
+        code := this.checkAccess(req.device, device, proxyHandle,
+          ACCESS_SUBSCRIBE)
+        if code != 0 {
+          this.audit(req.device, device, proxyHandle, opcode, value,
+            "denied", code)
+          resp := NewError(pkt[0], handleNum, code)
+          req.device.Respond(resp.msg)
+          return
         }
-      } else if false && pkt[0] == ATT_OPCODE_READ_REQUEST && proxyHandle.cachedValue != nil &&
-          (/*&& time.Since(proxyHandle.cachedTime) <=
-             time.Duration(interval) * time.Millisecond*/
-          !proxyHandle.cachedMap[req.device] || proxyHandle.cachedInfinite)  {
-        proxyHandle.cachedMap[req.device] = true
-        resp := make([]byte, 1 + len(proxyHandle.cachedValue))
-        resp[0] = ATT_OPCODE_READ_RESPONSE
-        copy(resp[1:], proxyHandle.cachedValue)
-        req.device.Respond(resp)
+      }
+
+      before := proxyCharHandle.effectiveCCCD()
+      prev, subscribed := proxyCharHandle.subscribers[req.device]
+      if cccd == 0 {
+        delete(proxyCharHandle.subscribers, req.device)
       } else {
+        proxyCharHandle.subscribers[req.device] = cccd
+      }
+      after := proxyCharHandle.effectiveCCCD()
+
+      if before != after {
+        // The union of subscriber configurations changed, so rewrite it on
+        // the peripheral. Translate packet handle with sutracted device offset
         pkt[1] = byte(remoteHandle & 0xff)
         pkt[2] = byte(remoteHandle >> 8)
-        if pkt[0] == ATT_OPCODE_WRITE_COMMAND || pkt[0] == ATT_OPCODE_SIGNED_WRITE_COMMAND {
-          device.WriteCmd(pkt)
-        } else {
-          device.Transaction(pkt, func(resp []byte, err error) {
-            if err != nil {
-              errResp := NewError(pkt[1], handleNum, 0x0E)
-              req.device.Respond(errResp.msg)
-            } else {
-              if resp[0] == ATT_OPCODE_READ_RESPONSE {
-                proxyHandle.cachedMap = make(map[*Device]bool)
-                proxyHandle.cachedMap[req.device] = true
-                proxyHandle.cachedValue = resp[1:]
-                proxyHandle.cachedTime = time.Now()
+        pkt[3] = byte(after & 0xff)
+        pkt[4] = byte(after >> 8)
+
+        this.transaction(device, pkt, func(resp []byte, err error) {
+          this.auditResponse(req.device, device, proxyHandle, opcode, value,
+            resp, err)
+          if err != nil || resp[0] != ATT_OPCODE_WRITE_RESPONSE {
+            // The peripheral wasn't configured, so undo the subscription
+            // unless the client has changed it again since
+            cur, ok := proxyCharHandle.subscribers[req.device]
+            if ok == (cccd != 0) && cur == cccd {
+              if subscribed {
+                proxyCharHandle.subscribers[req.device] = prev
+              } else {
+                delete(proxyCharHandle.subscribers, req.device)
               }
-              req.device.Respond(resp)
             }
-          })
-        }
+          }
+          if err != nil {
+            errResp := NewError(opcode, handleNum, 0x0E)
+            req.device.Respond(errResp.msg)
+          } else {
+            req.device.Respond(r.responseToClient(opcode, handleNum, resp))
+          }
+        })
+      } else {
+        this.audit(req.device, device, proxyHandle, opcode, value, "ok", 0)
+        req.device.Respond([]byte{ATT_OPCODE_WRITE_RESPONSE})
+      }
+    } else if false && pkt[0] == ATT_OPCODE_READ_REQUEST && proxyHandle.cachedValue != nil &&
+        (/*&& time.Since(proxyHandle.cachedTime) <=
+           time.Duration(interval) * time.Millisecond*/
+        !proxyHandle.cachedMap[req.device] || proxyHandle.cachedInfinite)  {
+      proxyHandle.cachedMap[req.device] = true
+      resp := make([]byte, 1 + len(proxyHandle.cachedValue))
+      resp[0] = ATT_OPCODE_READ_RESPONSE
+      copy(resp[1:], proxyHandle.cachedValue)
+      req.device.Respond(resp)
+    } else {
+      pkt[1] = byte(remoteHandle & 0xff)
+      pkt[2] = byte(remoteHandle >> 8)
+      if pkt[0] == ATT_OPCODE_WRITE_COMMAND || pkt[0] == ATT_OPCODE_SIGNED_WRITE_COMMAND {
+        this.audit(req.device, device, proxyHandle, opcode, value, "sent", 0)
+        device.WriteCmd(pkt)
+      } else {
+        this.transaction(device, pkt, func(resp []byte, err error) {
+          this.auditResponse(req.device, device, proxyHandle, opcode, value,
+            resp, err)
+          if err != nil {
+            errResp := NewError(opcode, handleNum, 0x0E)
+            req.device.Respond(errResp.msg)
+          } else {
+            if opcode == ATT_OPCODE_READ_REQUEST &&
+               resp[0] == ATT_OPCODE_READ_RESPONSE {
+              proxyHandle.cachedMap = make(map[*Device]bool)
+              proxyHandle.cachedMap[req.device] = true
+              proxyHandle.cachedValue = resp[1:]
+              proxyHandle.cachedTime = time.Now()
+            }
+            req.device.Respond(FitToMTU(r.responseToClient(opcode, handleNum,
+                                          resp), req.device.mtu))
+          }
+        })
       }
     }
   }
 }
-
@@ -0,0 +1,951 @@
+package ble
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// How long tests wait for any one packet
+const TEST_TIMEOUT = 2 * time.Second
+
+var errPipeTimeout = errors.New("Timed out waiting for a packet")
+
+// Adds a device connected over an in-memory pipe, returning it along with the
+// other end of the pipe, on which the caller plays the device.
+func (this *Manager) connectPipe(nick string) (*Device, net.Conn) {
+  conn, remote := net.Pipe()
+  device := this.AddDeviceForConn("pipe://" + nick, nick, conn, nil)
+  return device, remote
+}
+
+// A GATT client on the far end of an in-memory pipe, for driving the router
+// without a radio
+type pipeClient struct {
+  conn net.Conn
+  in   chan []byte
+}
+
+// Adds and starts a client device connected over an in-memory pipe.
+func (this *Manager) newPipeClient(nick string) *pipeClient {
+  device, conn := this.connectPipe(nick)
+  device.Start()
+
+  client := &pipeClient{conn, make(chan []byte, 16)}
+  go func() {
+    for {
+      buf := make([]byte, ATT_MAX_MTU)
+      n, err := conn.Read(buf)
+      if err != nil {
+        close(client.in)
+        return
+      }
+      client.in <- buf[0:n]
+    }
+  }()
+  return client
+}
+
+func (this *pipeClient) send(pkt []byte) error {
+  _, err := this.conn.Write(pkt)
+  return err
+}
+
+// Waits up to `timeout` for the next packet sent to the client.
+func (this *pipeClient) receive(timeout time.Duration) ([]byte, error) {
+  select {
+  case pkt, ok := <-this.in:
+    if !ok {
+      return nil, io.EOF
+    }
+    return pkt, nil
+  case <-time.After(timeout):
+    return nil, errPipeTimeout
+  }
+}
+
+// Sends a request and waits up to `timeout` for the response.
+func (this *pipeClient) request(pkt []byte,
+                                timeout time.Duration) ([]byte, error) {
+  if err := this.send(pkt); err != nil {
+    return nil, err
+  }
+  return this.receive(timeout)
+}
+
+// A manager serving a virtual peripheral "p", with a battery level and a
+// writable control point, to the pipe clients "c" and "c2"
+type routerTest struct {
+  t             testing.TB
+  manager       *Manager
+  vd            *VirtualDevice
+  periph        *Device
+  client        *pipeClient
+  client2       *pipeClient
+
+  // Handles on the virtual peripheral
+  level         uint16
+  control       uint16
+
+  // Offset of the peripheral's range in the clients' handle space
+  offset        uint16
+  subscriptions chan uint16
+
+  // Returns the peripheral's reply to a request in place of the virtual
+  // device's, or nil to pass the request on
+  replyMu       sync.Mutex
+  reply         func(pkt []byte) []byte
+}
+
+func newRouterTest(t testing.TB) *routerTest {
+  manager := NewManager(nil)
+  go manager.RunRouter()
+
+  vd := NewVirtualDevice("test")
+  vd.AddService(UUID16(0x180F))
+  level := vd.AddCharacteristic(UUID16(0x2A19),
+    GATT_PROP_READ | GATT_PROP_NOTIFY | GATT_PROP_INDICATE, []byte{99})
+  vd.AddService(UUID16(0x1815))
+  control := vd.AddCharacteristic(UUID16(0x2A56),
+    GATT_PROP_READ | GATT_PROP_WRITE, []byte{0})
+
+  test := &routerTest{t, manager, vd, nil, nil, nil, level, control, 0,
+    make(chan uint16, 8), sync.Mutex{}, nil}
+  vd.OnSubscribe(level, func(cccd uint16) {
+    test.subscriptions <- cccd
+  })
+  t.Cleanup(func() {
+    for _, nick := range manager.Nicks() {
+      manager.DisconnectFrom(nick)
+    }
+  })
+
+  periph, remote := manager.connectPipe("p")
+  test.periph = periph
+  test.relay(remote)
+  test.client = manager.newPipeClient("c")
+  test.client2 = manager.newPipeClient("c2")
+  manager.Serve("p", "c")
+  manager.Serve("p", "c2")
+  if err := manager.Start("p"); err != nil {
+    t.Fatalf("starting peripheral: %s", err)
+  }
+  r := test.rangeIn("c")
+  if r == nil {
+    t.Fatalf("peripheral not mapped into client")
+  }
+  test.offset = r.offset
+  return test
+}
+
+func le16(x uint16) []byte {
+  return []byte{byte(x & 0xff), byte(x >> 8)}
+}
+
+func pdu(opcode uint8, fields ...[]byte) []byte {
+  result := []byte{opcode}
+  for _, field := range fields {
+    result = append(result, field...)
+  }
+  return result
+}
+
+// Plays the peripheral on `conn` with the virtual device, except for requests
+// the test replies to itself.
+func (this *routerTest) relay(conn net.Conn) {
+  vdConn, remote := net.Pipe()
+  go this.vd.Serve(remote)
+  go func() {
+    defer conn.Close()
+    for {
+      buf := make([]byte, ATT_MAX_MTU)
+      n, err := vdConn.Read(buf)
+      if err != nil {
+        return
+      }
+      conn.Write(buf[0:n])
+    }
+  }()
+  go func() {
+    defer vdConn.Close()
+    for {
+      buf := make([]byte, ATT_MAX_MTU)
+      n, err := conn.Read(buf)
+      if err != nil {
+        return
+      }
+      this.replyMu.Lock()
+      reply := this.reply
+      this.replyMu.Unlock()
+      if reply != nil {
+        if resp := reply(buf[0:n]); resp != nil {
+          conn.Write(resp)
+          continue
+        }
+      }
+      vdConn.Write(buf[0:n])
+    }
+  }()
+}
+
+// Has the peripheral reply to requests with `opcode` with `resp`, or pass
+// every request on if `resp` is nil.
+func (this *routerTest) replyWith(opcode uint8, resp []byte) {
+  this.replyMu.Lock()
+  defer this.replyMu.Unlock()
+  this.reply = func(pkt []byte) []byte {
+    if pkt[0] == opcode {
+      return resp
+    }
+    return nil
+  }
+}
+
+// Translates a peripheral handle to the clients' handle space.
+func (this *routerTest) h(handle uint16) []byte {
+  return le16(handle + this.offset)
+}
+
+func (this *routerTest) expectPacket(got []byte, err error, want []byte) {
+  this.t.Helper()
+  if err != nil {
+    this.t.Fatalf("want %v: %s", want, err)
+  }
+  if !bytes.Equal(got, want) {
+    this.t.Fatalf("got %v, want %v", got, want)
+  }
+}
+
+// Sends `pkt` from `client` and checks the response is `want`.
+func (this *routerTest) requestFrom(client *pipeClient, pkt []byte,
+                                    want []byte) {
+  this.t.Helper()
+  got, err := client.request(pkt, TEST_TIMEOUT)
+  this.expectPacket(got, err, want)
+}
+
+func (this *routerTest) request(pkt []byte, want []byte) {
+  this.t.Helper()
+  this.requestFrom(this.client, pkt, want)
+}
+
+// Returns the peripheral's range in the handle space of the client `nick`.
+func (this *routerTest) rangeIn(nick string) *HandleRange {
+  var r *HandleRange
+  this.manager.do(func() {
+    if client, ok := this.manager.devices[nick]; ok {
+      r = client.rangeOf(this.periph)
+    }
+  })
+  return r
+}
+
+// Waits for the peripheral's client configuration to change to `want`.
+func (this *routerTest) expectSubscription(want uint16) {
+  this.t.Helper()
+  select {
+  case cccd := <-this.subscriptions:
+    if cccd != want {
+      this.t.Fatalf("peripheral configured with 0x%04X, want 0x%04X", cccd,
+        want)
+    }
+  case <-time.After(TEST_TIMEOUT):
+    this.t.Fatalf("peripheral not configured with 0x%04X", want)
+  }
+}
+
+// Subscribes a client to the battery level with `cccd`.
+func (this *routerTest) subscribe(client *pipeClient, cccd uint16) {
+  this.t.Helper()
+  this.requestFrom(client,
+    pdu(ATT_OPCODE_WRITE_REQUEST, this.h(this.level + 1), le16(cccd)),
+    []byte{ATT_OPCODE_WRITE_RESPONSE})
+}
+
+func TestDiscovery(t *testing.T) {
+  test := newRouterTest(t)
+  test.manager.do(func() {
+    if test.periph.highestHandle != test.vd.HighestHandle() ||
+       len(test.periph.handles) != int(test.vd.HighestHandle()) {
+      t.Errorf("discovered %d handles up to 0x%04X, want %d",
+        len(test.periph.handles), test.periph.highestHandle,
+        test.vd.HighestHandle())
+      return
+    }
+    level := test.periph.handles[test.level]
+    if level.uuid != UUID16(0x2A19) || level.charHandle != test.level - 1 ||
+       level.serviceHandle != 1 {
+      t.Errorf("battery level discovered as %v", level)
+    }
+  })
+}
+
+// Peripherals may reject secondary services as a grouping type
+func TestDiscoveryWithoutSecondaryServices(t *testing.T) {
+  test := newRouterTest(t)
+  for _, code := range []uint8{0x06, 0x10} {
+    code := code
+    test.replyMu.Lock()
+    test.reply = func(pkt []byte) []byte {
+      // Secondary Service UUID
+      if pkt[0] == ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST &&
+         bytes.HasSuffix(pkt, le16(0x2801)) {
+        return pdu(ATT_OPCODE_ERROR,
+          []byte{ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST}, le16(1), []byte{code})
+      }
+      return nil
+    }
+    test.replyMu.Unlock()
+    handles, err := Discover(test.periph)
+    if err != nil {
+      t.Fatalf("error 0x%02X: %s", code, err)
+    }
+    if len(handles) != int(test.vd.HighestHandle()) {
+      t.Errorf("error 0x%02X: discovered %d handles", code, len(handles))
+    }
+  }
+}
+
+func TestExchangeMTU(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(pdu(ATT_OPCODE_MTU_REQUEST, le16(247)),
+    pdu(ATT_OPCODE_MTU_RESPONSE, le16(ATT_MAX_MTU)))
+  var mtu uint16
+  test.manager.do(func() {
+    mtu = test.manager.devices["c"].MTU()
+  })
+  if mtu != 247 {
+    t.Fatalf("client MTU is %d, want 247", mtu)
+  }
+}
+
+func TestFindInfo(t *testing.T) {
+  test := newRouterTest(t)
+  // Room for every handle in one response
+  test.request(pdu(ATT_OPCODE_MTU_REQUEST, le16(247)),
+    pdu(ATT_OPCODE_MTU_RESPONSE, le16(ATT_MAX_MTU)))
+  uuids := []uint16{0x2800, 0x2803, 0x2A19, 0x2902, 0x2800, 0x2803, 0x2A56}
+  want := []byte{ATT_OPCODE_FIND_INFO_RESPONSE, 1}
+  for i, uuid := range uuids {
+    want = append(want, test.h(uint16(i + 1))...)
+    want = append(want, le16(uuid)...)
+  }
+  test.request(pdu(ATT_OPCODE_FIND_INFO_REQUEST, test.h(1), test.h(7)), want)
+}
+
+func TestFindByTypeValue(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(
+    pdu(ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST, le16(1), le16(0xffff),
+      le16(0x2800), le16(0x1815)),
+    // The last group found always ends at 0xFFFF
+    pdu(ATT_OPCODE_FIND_BY_TYPE_VALUE_RESPONSE, test.h(5), le16(0xffff)))
+}
+
+func TestReadByGroupType(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(
+    pdu(ATT_OPCODE_READ_BY_GROUP_TYPE_REQUEST, test.h(1), le16(0xffff),
+      le16(0x2800)),
+    pdu(ATT_OPCODE_READ_BY_GROUP_TYPE_RESPONSE, []byte{6},
+      test.h(1), test.h(4), le16(0x180F), test.h(5), test.h(7), le16(0x1815)))
+}
+
+func TestReadByType(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(
+    pdu(ATT_OPCODE_READ_BY_TYPE_REQUEST, test.h(1), le16(0xffff),
+      le16(0x2803)),
+    pdu(ATT_OPCODE_READ_BY_TYPE_RESPONSE, []byte{7},
+      test.h(2), []byte{0x32}, test.h(3), le16(0x2A19),
+      test.h(6), []byte{0x0A}, test.h(7), le16(0x2A56)))
+}
+
+// Entries too long for the client's MTU keep the start of their value
+func TestReadByTypeLongValue(t *testing.T) {
+  test := newRouterTest(t)
+  name := strings.Repeat("n", 30)
+  test.manager.SetName(name)
+  test.request(
+    pdu(ATT_OPCODE_READ_BY_TYPE_REQUEST, le16(1), le16(0xffff), le16(0x2A00)),
+    pdu(ATT_OPCODE_READ_BY_TYPE_RESPONSE, []byte{21},
+      le16(test.manager.localDB.Find(GAP_DEVICE_NAME_UUID)),
+      []byte(name[:19])))
+
+  test.replyWith(ATT_OPCODE_READ_BY_TYPE_REQUEST,
+    pdu(ATT_OPCODE_READ_BY_TYPE_RESPONSE, []byte{32}, le16(test.level),
+      []byte(name)))
+  test.request(
+    pdu(ATT_OPCODE_READ_BY_TYPE_REQUEST, le16(1), le16(0xffff), le16(0x2A19)),
+    pdu(ATT_OPCODE_READ_BY_TYPE_RESPONSE, []byte{21}, test.h(test.level),
+      []byte(name[:19])))
+}
+
+func TestRead(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level)),
+    []byte{ATT_OPCODE_READ_RESPONSE, 99})
+}
+
+func TestReadMultiple(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(
+    pdu(ATT_OPCODE_READ_MULTIPLE_REQUEST, test.h(test.level),
+      test.h(test.control)),
+    []byte{ATT_OPCODE_READ_MULTIPLE_RESPONSE, 99, 0})
+}
+
+func TestReadMultipleMalformedReply(t *testing.T) {
+  test := newRouterTest(t)
+  read := pdu(ATT_OPCODE_READ_MULTIPLE_REQUEST, test.h(test.level),
+    test.h(test.control))
+  unlikely := pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_READ_MULTIPLE_REQUEST},
+    test.h(test.level), []byte{0x0E})
+
+  test.replyWith(ATT_OPCODE_READ_MULTIPLE_REQUEST, []byte{ATT_OPCODE_ERROR})
+  test.request(read, unlikely)
+  // The wrong response
+  test.replyWith(ATT_OPCODE_READ_MULTIPLE_REQUEST,
+    []byte{ATT_OPCODE_READ_RESPONSE, 1})
+  test.request(read, unlikely)
+
+  // Runs of one handle are read with a Read Request
+  read = pdu(ATT_OPCODE_READ_MULTIPLE_REQUEST, le16(1), test.h(test.level))
+  test.replyWith(ATT_OPCODE_READ_REQUEST, []byte{ATT_OPCODE_ERROR, 0x0A})
+  test.request(read, unlikely)
+}
+
+func TestAccessPolicy(t *testing.T) {
+  test := newRouterTest(t)
+  err := test.manager.SetPolicy(&Policy{"allow", []PolicyRule{
+    {Client: "c", Characteristic: "2A19", Access: []string{"read"},
+      Action: "deny"},
+    {Client: "c", Service: "1815", Action: "unauthorized"},
+  }})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  test.request(pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level)),
+    pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_READ_REQUEST},
+      test.h(test.level), []byte{0x02}))
+  test.request(
+    pdu(ATT_OPCODE_WRITE_REQUEST, test.h(test.control), []byte{5}),
+    pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_WRITE_REQUEST},
+      test.h(test.control), []byte{0x08}))
+  if value := test.vd.Value(test.control); !bytes.Equal(value, []byte{0}) {
+    t.Fatalf("peripheral has %v, want [0]", value)
+  }
+
+  // Other clients are unaffected
+  test.requestFrom(test.client2,
+    pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level)),
+    []byte{ATT_OPCODE_READ_RESPONSE, 99})
+}
+
+func TestFindByTypeValuePolicy(t *testing.T) {
+  test := newRouterTest(t)
+  // Reading the battery level caches its value
+  test.requestFrom(test.client2,
+    pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level)),
+    []byte{ATT_OPCODE_READ_RESPONSE, 99})
+  find := pdu(ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST, le16(1), le16(0xffff),
+    le16(0x2A19), []byte{99})
+  test.request(find,
+    pdu(ATT_OPCODE_FIND_BY_TYPE_VALUE_RESPONSE, test.h(test.level),
+      le16(0xffff)))
+
+  err := test.manager.SetPolicy(&Policy{"allow", []PolicyRule{
+    {Client: "c", Characteristic: "2A19", Access: []string{"read"},
+      Action: "deny"},
+  }})
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The battery level can't be found by its value
+  test.request(find,
+    pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_FIND_BY_TYPE_VALUE_REQUEST},
+      le16(1), []byte{0x0A}))
+}
+
+func TestWrite(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(
+    pdu(ATT_OPCODE_WRITE_REQUEST, test.h(test.control), []byte{5}),
+    []byte{ATT_OPCODE_WRITE_RESPONSE})
+  if value := test.vd.Value(test.control); !bytes.Equal(value, []byte{5}) {
+    t.Fatalf("peripheral has %v, want [5]", value)
+  }
+}
+
+func TestPreparedWrite(t *testing.T) {
+  test := newRouterTest(t)
+  prepare := pdu(ATT_OPCODE_PREPARE_WRITE_REQUEST, test.h(test.control),
+    le16(0), []byte{1, 2})
+  test.request(prepare, pdu(ATT_OPCODE_PREPARE_WRITE_RESPONSE, prepare[1:]))
+  prepare = pdu(ATT_OPCODE_PREPARE_WRITE_REQUEST, test.h(test.control),
+    le16(2), []byte{3})
+  test.request(prepare, pdu(ATT_OPCODE_PREPARE_WRITE_RESPONSE, prepare[1:]))
+  test.request(
+    []byte{ATT_OPCODE_EXECUTE_WRITE_REQUEST, ATT_EXECUTE_WRITE_COMMIT},
+    []byte{ATT_OPCODE_EXECUTE_WRITE_RESPONSE})
+  value := test.vd.Value(test.control)
+  if !bytes.Equal(value, []byte{1, 2, 3}) {
+    t.Fatalf("peripheral has %v, want [1 2 3]", value)
+  }
+}
+
+func TestConnUpdate(t *testing.T) {
+  test := newRouterTest(t)
+  test.request(pdu(ATT_OPCODE_CONN_UPDATE, le16(6)), []byte{0xff})
+}
+
+func TestNotifyFanOut(t *testing.T) {
+  test := newRouterTest(t)
+  test.subscribe(test.client, GATT_CCCD_NOTIFY)
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+  // The peripheral is already configured for notifications
+  test.subscribe(test.client2, GATT_CCCD_NOTIFY)
+
+  if err := test.vd.Notify(test.level, []byte{98}); err != nil {
+    t.Fatal(err)
+  }
+  want := pdu(ATT_OPCODE_HANDLE_VALUE_NOTIFICATION, test.h(test.level),
+    []byte{98})
+  for _, client := range []*pipeClient{test.client, test.client2} {
+    got, err := client.receive(TEST_TIMEOUT)
+    test.expectPacket(got, err, want)
+  }
+}
+
+func TestIndicateFanOut(t *testing.T) {
+  test := newRouterTest(t)
+  cccd := GATT_CCCD_NOTIFY | GATT_CCCD_INDICATE
+  test.subscribe(test.client, cccd)
+  test.expectSubscription(cccd)
+  test.subscribe(test.client2, cccd)
+
+  done := make(chan error, 1)
+  go func() {
+    done <- test.vd.Indicate(test.level, []byte{97})
+  }()
+  want := pdu(ATT_OPCODE_HANDLE_VALUE_INDICATION, test.h(test.level),
+    []byte{97})
+  for _, client := range []*pipeClient{test.client, test.client2} {
+    got, err := client.receive(TEST_TIMEOUT)
+    test.expectPacket(got, err, want)
+    client.send([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+  }
+  select {
+  case err := <-done:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <-time.After(TEST_TIMEOUT):
+    t.Fatalf("indication not confirmed to peripheral")
+  }
+}
+
+func TestDisconnectCleanup(t *testing.T) {
+  test := newRouterTest(t)
+  test.subscribe(test.client, GATT_CCCD_NOTIFY | GATT_CCCD_INDICATE)
+  test.expectSubscription(GATT_CCCD_NOTIFY | GATT_CCCD_INDICATE)
+  test.subscribe(test.client2, GATT_CCCD_NOTIFY)
+
+  // The second client's configuration remains
+  test.manager.DisconnectFrom("c")
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+  test.manager.DisconnectFrom("c2")
+  test.expectSubscription(0)
+
+  test.client = test.manager.newPipeClient("c3")
+  test.manager.Serve("p", "c3")
+  test.manager.DisconnectFrom("p")
+  if r := test.rangeIn("c3"); r != nil {
+    t.Fatalf("peripheral still mapped at %s", r)
+  }
+  test.request(pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level)),
+    pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_READ_REQUEST},
+      test.h(test.level), []byte{0x01}))
+}
+
+// Waits for a device nicknamed `nick` to be added.
+func (this *Manager) awaitDevice(t *testing.T, nick string) {
+  t.Helper()
+  deadline := time.Now().Add(TEST_TIMEOUT)
+  for time.Now().Before(deadline) {
+    for _, n := range this.Nicks() {
+      if n == nick {
+        return
+      }
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("%s never added", nick)
+}
+
+func TestListenTCP(t *testing.T) {
+  manager := NewManager(nil)
+  go manager.RunRouter()
+  ln, err := manager.ListenTCP("127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  conn, err := net.Dial("tcp", ln.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  manager.awaitDevice(t, "tcp://" + conn.LocalAddr().String())
+
+  if err := ln.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+    conn.Close()
+    t.Fatalf("still accepting once closed")
+  }
+}
+
+func TestListenUnix(t *testing.T) {
+  manager := NewManager(nil)
+  go manager.RunRouter()
+  path := filepath.Join(t.TempDir(), "beetle")
+  ln, err := manager.ListenUnix(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  conn, err := net.Dial("unixpacket", path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  manager.awaitDevice(t, "unix://" + path + "#0")
+
+  if err := ln.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := os.Lstat(path); !os.IsNotExist(err) {
+    t.Fatalf("socket left behind: %v", err)
+  }
+}
+
+// A transaction queued behind an unanswered one gives up without failing the
+// link
+func TestTransactionDeadline(t *testing.T) {
+  manager := NewManager(nil)
+  go manager.RunRouter()
+  device, remote := manager.connectPipe("p")
+  device.Start()
+  defer device.Disconnect()
+  read := []byte{ATT_OPCODE_READ_REQUEST, 1, 0}
+
+  first := make(chan Response, 1)
+  go func() {
+    first <- device.transact(read, time.Now().Add(ATT_TRANSACTION_TIMEOUT))
+  }()
+  buf := make([]byte, ATT_MAX_MTU)
+  if _, err := remote.Read(buf); err != nil {
+    t.Fatal(err)
+  }
+  resp := device.transact(read, time.Now().Add(50 * time.Millisecond))
+  if resp.err != ErrTransactionTimeout || device.Failed() {
+    t.Fatalf("queued transaction got %v, link failed %v", resp.err,
+      device.Failed())
+  }
+
+  remote.Write([]byte{ATT_OPCODE_READ_RESPONSE, 7})
+  select {
+  case resp := <-first:
+    if resp.err != nil ||
+       !bytes.Equal(resp.value, []byte{ATT_OPCODE_READ_RESPONSE, 7}) {
+      t.Fatalf("first transaction got %v, %v", resp.value, resp.err)
+    }
+  case <-time.After(TEST_TIMEOUT):
+    t.Fatalf("first transaction not answered")
+  }
+}
+
+func TestLinkLoss(t *testing.T) {
+  test := newRouterTest(t)
+  sc := test.manager.localDB.Find(GATT_SERVICE_CHANGED_UUID)
+  test.request(pdu(ATT_OPCODE_WRITE_REQUEST, le16(sc + 1),
+    le16(GATT_CCCD_INDICATE)), []byte{ATT_OPCODE_WRITE_RESPONSE})
+
+  var end uint16
+  test.manager.do(func() {
+    test.manager.ReconnectInterval = 10 * time.Millisecond
+    test.periph.redial = func() (io.ReadWriteCloser, *ConnInfo, error) {
+      conn, remote := net.Pipe()
+      go test.vd.Serve(remote)
+      return conn, nil, nil
+    }
+    end = test.manager.devices["c"].rangeOf(test.periph).end
+  })
+  test.periph.link().Close()
+
+  // Once when the link drops and again when it is back
+  want := pdu(ATT_OPCODE_HANDLE_VALUE_INDICATION, le16(sc),
+    test.h(1), le16(end))
+  for i := 0; i < 2; i++ {
+    got, err := test.client.receive(TEST_TIMEOUT)
+    test.expectPacket(got, err, want)
+    test.client.send([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+  }
+  test.request(pdu(ATT_OPCODE_READ_REQUEST, test.h(test.level)),
+    []byte{ATT_OPCODE_READ_RESPONSE, 99})
+}
+
+// A peripheral that comes back without its configuration is reconfigured
+func TestLinkLossRestoresSubscriptions(t *testing.T) {
+  test := newRouterTest(t)
+  test.subscribe(test.client, GATT_CCCD_NOTIFY)
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+
+  vd := NewVirtualDevice("test")
+  vd.AddService(UUID16(0x180F))
+  level := vd.AddCharacteristic(UUID16(0x2A19),
+    GATT_PROP_READ | GATT_PROP_NOTIFY | GATT_PROP_INDICATE, []byte{99})
+  vd.AddService(UUID16(0x1815))
+  vd.AddCharacteristic(UUID16(0x2A56), GATT_PROP_READ | GATT_PROP_WRITE,
+    []byte{0})
+  vd.OnSubscribe(level, func(cccd uint16) {
+    test.subscriptions <- cccd
+  })
+  test.manager.do(func() {
+    test.manager.ReconnectInterval = 10 * time.Millisecond
+    test.periph.redial = func() (io.ReadWriteCloser, *ConnInfo, error) {
+      conn, remote := net.Pipe()
+      go vd.Serve(remote)
+      return conn, nil, nil
+    }
+  })
+  test.periph.link().Close()
+
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+  test.manager.do(func() {
+    client := test.manager.devices["c"]
+    if cccd := test.periph.handles[level].subscribers[client];
+       cccd != GATT_CCCD_NOTIFY {
+      t.Errorf("subscription 0x%04X after reconnecting", cccd)
+    }
+  })
+}
+
+func TestRediscoveryRestoresSubscriptions(t *testing.T) {
+  test := newRouterTest(t)
+  test.subscribe(test.client, GATT_CCCD_NOTIFY)
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+  go test.manager.queueRediscovery(test.periph)
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+}
+
+func TestRejectedSubscription(t *testing.T) {
+  test := newRouterTest(t)
+  test.vd.OnWrite(test.level + 1, func(value []byte) uint8 {
+    return 0xFD
+  })
+  test.request(
+    pdu(ATT_OPCODE_WRITE_REQUEST, test.h(test.level + 1),
+      le16(GATT_CCCD_NOTIFY)),
+    pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_WRITE_REQUEST},
+      test.h(test.level + 1), []byte{0xFD}))
+  test.manager.do(func() {
+    if subscribers := test.periph.handles[test.level].subscribers;
+       len(subscribers) != 0 {
+      t.Errorf("subscribers kept after rejection: %v", subscribers)
+    }
+  })
+}
+
+func TestConfigurationOnlyByWriteRequest(t *testing.T) {
+  test := newRouterTest(t)
+  test.subscribe(test.client, GATT_CCCD_NOTIFY)
+  test.expectSubscription(GATT_CCCD_NOTIFY)
+
+  cccd := test.h(test.level + 1)
+  test.client2.send(pdu(ATT_OPCODE_WRITE_COMMAND, cccd, le16(0)))
+  prepare := pdu(ATT_OPCODE_PREPARE_WRITE_REQUEST, cccd, le16(0), le16(0))
+  test.requestFrom(test.client2, prepare,
+    pdu(ATT_OPCODE_ERROR, []byte{ATT_OPCODE_PREPARE_WRITE_REQUEST}, cccd,
+      []byte{0x06}))
+
+  // The first client's subscription stands
+  if err := test.vd.Notify(test.level, []byte{98}); err != nil {
+    t.Fatal(err)
+  }
+  got, err := test.client.receive(TEST_TIMEOUT)
+  test.expectPacket(got, err, pdu(ATT_OPCODE_HANDLE_VALUE_NOTIFICATION,
+    test.h(test.level), []byte{98}))
+}
+
+// Waits for the response to a request, confirming indications and skipping
+// notifications that arrive first.
+func (this *pipeClient) exchange(pkt []byte) ([]byte, error) {
+  if err := this.send(pkt); err != nil {
+    return nil, err
+  }
+  for {
+    resp, err := this.receive(TEST_TIMEOUT)
+    if err != nil {
+      return nil, err
+    }
+    switch resp[0] {
+    case ATT_OPCODE_HANDLE_VALUE_INDICATION:
+      this.send([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+    case ATT_OPCODE_HANDLE_VALUE_NOTIFICATION:
+    default:
+      return resp, nil
+    }
+  }
+}
+
+// Clients come and go, serving, subscribing, reading and writing while
+// virtual peripherals notify and indicate. Meant to be run with -race.
+func TestConcurrentClients(t *testing.T) {
+  manager := NewManager(nil)
+  go manager.RunRouter()
+  t.Cleanup(func() {
+    for _, nick := range manager.Nicks() {
+      manager.DisconnectFrom(nick)
+    }
+  })
+
+  const PERIPHERALS = 3
+  const WORKERS = 4
+  const ROUNDS = 10
+  vds := make([]*VirtualDevice, PERIPHERALS)
+  periphs := make([]*Device, PERIPHERALS)
+  nicks := make([]string, PERIPHERALS)
+  var level, control uint16
+  for i := range vds {
+    vd := NewVirtualDevice(fmt.Sprintf("v%d", i))
+    vd.AddService(UUID16(0x180F))
+    level = vd.AddCharacteristic(UUID16(0x2A19),
+      GATT_PROP_READ | GATT_PROP_NOTIFY | GATT_PROP_INDICATE, []byte{99})
+    control = vd.AddCharacteristic(UUID16(0x2A56),
+      GATT_PROP_READ | GATT_PROP_WRITE, []byte{0})
+    vds[i] = vd
+    nicks[i] = fmt.Sprintf("p%d", i)
+    periphs[i] = manager.AddVirtualDevice(nicks[i], vd)
+  }
+
+  stop := make(chan struct{})
+  var notifiers sync.WaitGroup
+  for _, vd := range vds {
+    notifiers.Add(1)
+    go func(vd *VirtualDevice) {
+      defer notifiers.Done()
+      for {
+        select {
+        case <-stop:
+          return
+        default:
+        }
+        vd.Notify(level, []byte{98})
+        vd.Indicate(level, []byte{97})
+      }
+    }(vd)
+  }
+
+  errs := make(chan error, WORKERS)
+  var workers sync.WaitGroup
+  for w := 0; w < WORKERS; w++ {
+    workers.Add(1)
+    go func(w int) {
+      defer workers.Done()
+      for n := 0; n < ROUNDS; n++ {
+        err := clientRound(manager, fmt.Sprintf("c%d-%d", w, n), nicks,
+          periphs, level, control)
+        if err != nil {
+          errs <- err
+          return
+        }
+      }
+    }(w)
+  }
+  workers.Wait()
+  close(stop)
+
+  done := make(chan struct{})
+  go func() {
+    notifiers.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+  case <-time.After(5 * TEST_TIMEOUT):
+    t.Fatalf("peripherals still indicating")
+  }
+  close(errs)
+  for err := range errs {
+    t.Error(err)
+  }
+
+  // Every subscription left with its client
+  manager.do(func() {
+    for i, periph := range periphs {
+      if subscribers := periph.handles[level].subscribers;
+         len(subscribers) != 0 {
+        t.Errorf("%s still has subscribers %v", nicks[i], subscribers)
+      }
+    }
+  })
+}
+
+// Connects a client, has it use every peripheral, and disconnects it.
+func clientRound(manager *Manager, nick string, nicks []string,
+                 periphs []*Device, level, control uint16) error {
+  client := manager.newPipeClient(nick)
+  defer manager.DisconnectFrom(nick)
+
+  ranges := make([]*HandleRange, len(periphs))
+  for i, periph := range periphs {
+    if err := manager.Serve(nicks[i], nick); err != nil {
+      return err
+    }
+    manager.do(func() {
+      ranges[i] = manager.devices[nick].rangeOf(periph)
+    })
+    if ranges[i] == nil {
+      return fmt.Errorf("%s not served to %s", nicks[i], nick)
+    }
+  }
+
+  for i, r := range ranges {
+    h := func(handle uint16) []byte {
+      return le16(handle + r.offset)
+    }
+    reqs := [][]byte{
+      pdu(ATT_OPCODE_WRITE_REQUEST, h(level + 1),
+        le16(GATT_CCCD_NOTIFY | GATT_CCCD_INDICATE)),
+      pdu(ATT_OPCODE_READ_REQUEST, h(level)),
+      pdu(ATT_OPCODE_WRITE_REQUEST, h(control), []byte{byte(i)}),
+      pdu(ATT_OPCODE_READ_MULTIPLE_REQUEST, h(level), h(control)),
+      pdu(ATT_OPCODE_READ_BY_TYPE_REQUEST, le16(1), le16(0xffff),
+        le16(0x2803)),
+    }
+    for _, req := range reqs {
+      resp, err := client.exchange(req)
+      if err != nil {
+        return fmt.Errorf("%s: %v: %s", nick, req, err)
+      }
+      if resp[0] != req[0] + 1 {
+        return fmt.Errorf("%s: %v: got %v", nick, req, resp)
+      }
+    }
+  }
+  // Stop serving one peripheral before disconnecting
+  if len(nicks) > 1 {
+    return manager.Unserve(nicks[1], nick)
+  }
+  return nil
+}
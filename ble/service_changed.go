@@ -0,0 +1,156 @@
+package ble
+
+import (
+  "fmt"
+  "net"
+)
+
+// Result of discovery run off the router goroutine
+type discovery struct {
+  device  *Device
+  handles map[uint16]*Handle
+}
+
+// Creates the device standing in for Beetle's own attribute database. It is
+// mapped at the start of every client's handle space and is accessed through
+// the same paths as a peripheral, but is served in-process.
+func (this *Manager) newLocalDevice(db *LocalDatabase) *Device {
+  handles := attributeHandles(db.attrs)
+  conn, serverConn := net.Pipe()
+  go newAttributeServer(db, ATT_MAX_MTU).serve(serverConn)
+
+  device := NewDevice("beetle", this.requestChan, conn, nil)
+  device.mtu = ATT_MAX_MTU
+  device.setHandles(handles)
+  device.Start()
+  return device
+}
+
+// Indicates to `client`, if it is subscribed to Beetle's Service Changed
+// characteristic, that handles `start` to `end` of its handle space changed.
+func (this *Manager) serviceChanged(client *Device, start, end uint16) {
+  h := this.localDB.Find(GATT_SERVICE_CHANGED_UUID)
+  handle, ok := this.local.handles[h]
+  if !ok || handle.subscribers[client] & GATT_CCCD_INDICATE == 0 {
+    return
+  }
+
+  pkt := []byte{ATT_OPCODE_HANDLE_VALUE_INDICATION, byte(h & 0xff), byte(h >> 8),
+    byte(start & 0xff), byte(start >> 8), byte(end & 0xff), byte(end >> 8)}
+  ind := &indication{this.local, map[*Device]bool{client: true}, false}
+  this.queueIndication(ind, client, pkt)
+}
+
+// Indicates a change to the handles of `r` to its client.
+func (this *Manager) rangeChanged(client *Device, r *HandleRange) {
+  if r != nil {
+    this.serviceChanged(client, r.offset + 1, r.end)
+  }
+}
+
+// Indicates a change to the handles of `device` to every client it is served
+// to.
+func (this *Manager) servedRangesChanged(device *Device) {
+  for client, exposed := range this.exposures {
+    if exposed[device] {
+      this.rangeChanged(client, client.rangeOf(device))
+    }
+  }
+}
+
+// Subscribes Beetle to the peripheral's Service Changed characteristic, if it
+// has one, so it learns when the peripheral's database changes.
+func (this *Manager) subscribeServiceChanged(device *Device) {
+  for _, handle := range device.sorted {
+    if handle.uuid != GATT_SERVICE_CHANGED_UUID {
+      continue
+    }
+    before := handle.effectiveCCCD()
+    handle.subscribers[this.local] = GATT_CCCD_INDICATE
+    after := handle.effectiveCCCD()
+    cccd := device.cccdFor(handle)
+    if before == after || cccd == nil {
+      continue
+    }
+    h := cccd.handle
+    device.Transaction(
+      []byte{ATT_OPCODE_WRITE_REQUEST, byte(h & 0xff), byte(h >> 8),
+             byte(after & 0xff), byte(after >> 8)},
+      func(resp []byte, err error){})
+  }
+}
+
+// Handles a Service Changed indication from a peripheral. Beetle confirms it
+// itself and rediscovers the peripheral rather than forwarding it, since the
+// peripheral's handles don't mean anything to clients.
+func (this *Manager) peripheralServiceChanged(device *Device) {
+  device.WriteCmd([]byte{ATT_OPCODE_HANDLE_VALUE_CONFIRMATION})
+  this.invalidateCache(device)
+  go this.queueRediscovery(device)
+}
+
+// Runs full discovery on a peripheral and hands the result to the router to
+// apply. Does not run on the router goroutine, which must keep routing the
+// peripheral's packets while discovery is in progress.
+func (this *Manager) queueRediscovery(device *Device) {
+  handles, err := Discover(device)
+  if err != nil {
+    // The old handles stay in use. A failed link, the usual cause, is
+    // handled as a lost link.
+    if Debug {
+      fmt.Printf("%s: rediscovery failed: %s\n", device.addr, err)
+    }
+    return
+  }
+  this.saveCache(device, handles)
+  this.discovered <- &discovery{device, handles}
+}
+
+// Replaces a peripheral's handles with newly discovered ones. Subscriptions to
+// handles that are unchanged are kept and rewritten to the peripheral, and
+// every client the peripheral is served to is told which of its handles
+// changed.
+func (this *Manager) applyDiscovery(device *Device,
+                                   handles map[uint16]*Handle) error {
+  if this.nickOf(device) == "" {
+    // Removed while discovery was running
+    return nil
+  }
+
+  for h, old := range device.handles {
+    if handle, ok := handles[h]; ok && handle.uuid == old.uuid {
+      handle.subscribers = old.subscribers
+    }
+  }
+  device.setHandles(handles)
+  this.restoreSubscriptions(device)
+  this.subscribeServiceChanged(device)
+
+  for client, exposed := range this.exposures {
+    if !exposed[device] {
+      continue
+    }
+    old := client.rangeOf(device)
+    if old != nil && old.end - old.offset == device.highestHandle {
+      this.rangeChanged(client, old)
+      continue
+    }
+
+    // The peripheral no longer fits its range, so give it a new one
+    client.unmapRange(device)
+    r, err := client.mapRange(device)
+    if err != nil {
+      this.rangeChanged(client, old)
+      return err
+    }
+    start, end := r.offset, r.end
+    if old != nil && old.offset < start {
+      start = old.offset
+    }
+    if old != nil && old.end > end {
+      end = old.end
+    }
+    this.serviceChanged(client, start + 1, end)
+  }
+  return nil
+}
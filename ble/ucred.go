@@ -0,0 +1,41 @@
+package ble
+
+import (
+  "fmt"
+  "net"
+  "syscall"
+)
+
+// Identity of the process on the other end of a local (Unix domain socket)
+// connection, as reported by the kernel.
+type Credentials struct {
+  Pid int32
+  Uid uint32
+  Gid uint32
+}
+
+func (this *Credentials) String() string {
+  return fmt.Sprintf("pid=%d uid=%d gid=%d", this.Pid, this.Uid, this.Gid)
+}
+
+func GetPeerCredentials(conn *net.UnixConn) (*Credentials, error) {
+  rc, err := conn.SyscallConn()
+  if err != nil {
+    return nil, err
+  }
+
+  var ucred *syscall.Ucred
+  var credErr error
+  err = rc.Control(func(fd uintptr) {
+    ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+      syscall.SO_PEERCRED)
+  })
+  if err != nil {
+    return nil, err
+  }
+  if credErr != nil {
+    return nil, credErr
+  }
+
+  return &Credentials{ucred.Pid, ucred.Uid, ucred.Gid}, nil
+}
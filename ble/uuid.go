@@ -0,0 +1,65 @@
+package ble
+
+import (
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "strings"
+)
+
+// Parses a UUID in its canonical form ("0000180d-0000-1000-8000-00805f9b34fb",
+// with or without dashes) or as a 16-bit assigned number ("180D" or
+// "0x180D").
+func ParseUUID(str string) (UUID, error) {
+  s := strings.TrimPrefix(strings.TrimPrefix(str, "0x"), "0X")
+  if len(s) == 36 {
+    if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+      return UUID{}, errors.New("Invalid UUID " + str)
+    }
+    s = strings.Replace(s, "-", "", -1)
+  }
+  if len(s) != 4 && len(s) != 32 {
+    return UUID{}, errors.New("Invalid UUID " + str)
+  }
+
+  b, err := hex.DecodeString(s)
+  if err != nil {
+    return UUID{}, errors.New("Invalid UUID " + str)
+  }
+  // Text is most significant octet first, ATT the reverse
+  for i, j := 0, len(b) - 1; i < j; i, j = i + 1, j - 1 {
+    b[i], b[j] = b[j], b[i]
+  }
+  return DecodeUUID(b), nil
+}
+
+// Formats 16-bit UUIDs as their assigned number, e.g. "2A37", and others in
+// canonical form.
+func (this UUID) String() string {
+  if this.Is16Bit() {
+    return fmt.Sprintf("%04X", uint16(this[2]) | uint16(this[3]) << 8)
+  }
+  b := make([]byte, 16)
+  for j := 0; j < 16; j++ {
+    b[j] = this[15 - j]
+  }
+  s := hex.EncodeToString(b)
+  return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// Returns the Bluetooth SIG name of a 16-bit UUID, e.g. "Heart Rate
+// Measurement", or "" if it isn't in ASSIGNED_NUMBERS.
+func (this UUID) Name() string {
+  if !this.Is16Bit() {
+    return ""
+  }
+  return ASSIGNED_NUMBERS[uint16(this[2]) | uint16(this[3]) << 8]
+}
+
+// Returns the UUID's name if known, otherwise its string form.
+func (this UUID) Describe() string {
+  if name := this.Name(); name != "" {
+    return name
+  }
+  return this.String()
+}
@@ -0,0 +1,202 @@
+package ble
+
+import (
+  "errors"
+  "net"
+  "sync"
+  "time"
+)
+
+// Returns the current value of a characteristic when a client reads it
+type ReadHandler func() []byte
+
+// Handles a client's write to a characteristic. Returns 0 to accept the value,
+// or an ATT error code to reject it.
+type WriteHandler func(value []byte) uint8
+
+// Called when the client configuration of a characteristic changes, i.e. when
+// its first subscriber arrives or its last one leaves
+type SubscribeHandler func(cccd uint16)
+
+// A peripheral implemented in Go rather than reached over a link. Services and
+// characteristics are added with the LocalDatabase methods, optionally with
+// handlers, before the device is added to a Manager with AddVirtualDevice or
+// served over a connection with Serve.
+type VirtualDevice struct {
+  *LocalDatabase
+  name          string
+
+  // The connection being served, if any
+  conn          net.Conn
+  server        *attributeServer
+
+  // Guards `conn`, `server`, `subscriptions` and `subscribeHandlers`
+  mu                sync.Mutex
+  subscriptions     map[uint16]uint16
+  subscribeHandlers map[uint16]SubscribeHandler
+  // Serializes indications, only one of which may be outstanding
+  indicateMu        sync.Mutex
+}
+
+func NewVirtualDevice(name string) *VirtualDevice {
+  return &VirtualDevice{NewLocalDatabase(), name, nil, nil, sync.Mutex{},
+    make(map[uint16]uint16), make(map[uint16]SubscribeHandler), sync.Mutex{}}
+}
+
+func (this *VirtualDevice) Name() string {
+  return this.name
+}
+
+// Sets the handler for reads of the characteristic value at `handle`.
+func (this *VirtualDevice) OnRead(handle uint16, handler ReadHandler) error {
+  attr := this.find(handle)
+  if attr == nil {
+    return errors.New("No such handle")
+  }
+  attr.read = handler
+  return nil
+}
+
+// Sets the handler for writes to the characteristic value at `handle`.
+func (this *VirtualDevice) OnWrite(handle uint16, handler WriteHandler) error {
+  attr := this.find(handle)
+  if attr == nil {
+    return errors.New("No such handle")
+  }
+  attr.write = handler
+  return nil
+}
+
+// Sets the handler for subscription changes to the characteristic whose value
+// is at `handle`.
+func (this *VirtualDevice) OnSubscribe(handle uint16,
+                                       handler SubscribeHandler) error {
+  if this.cccdOf(handle) == nil {
+    return errors.New("Characteristic does not notify or indicate")
+  }
+  this.mu.Lock()
+  defer this.mu.Unlock()
+  this.subscribeHandlers[handle] = handler
+  return nil
+}
+
+// Returns the client characteristic configuration descriptor of the
+// characteristic whose value is at `handle`, which AddCharacteristic places
+// right after the value.
+func (this *VirtualDevice) cccdOf(handle uint16) *attribute {
+  attr := this.find(handle + 1)
+  if attr == nil || attr.uuid != GATT_CLIENT_CONFIGURATION_UUID {
+    return nil
+  }
+  return attr
+}
+
+// Serves the device's attributes to a single client over `conn` until the
+// connection is closed. Subscriptions start out empty on each connection.
+func (this *VirtualDevice) Serve(conn net.Conn) {
+  this.serve(conn, ATT_DEFAULT_MTU)
+}
+
+func (this *VirtualDevice) serve(conn net.Conn, mtu uint16) {
+  server := newAttributeServer(this.LocalDatabase, mtu)
+  this.mu.Lock()
+  this.conn = conn
+  this.server = server
+  this.subscriptions = make(map[uint16]uint16)
+  this.mu.Unlock()
+  this.resetClientConfigurations()
+
+  server.serve(conn)
+  conn.Close()
+
+  this.mu.Lock()
+  if this.conn == conn {
+    this.conn = nil
+    this.server = nil
+  }
+  this.mu.Unlock()
+}
+
+// Clears the client configuration descriptors and routes writes to them
+// through the device's subscription tracking.
+func (this *VirtualDevice) resetClientConfigurations() {
+  for _, attr := range this.attrs {
+    if attr.uuid != GATT_CLIENT_CONFIGURATION_UUID {
+      continue
+    }
+    this.setValue(attr, []byte{0, 0})
+    valueHandle := attr.handle - 1
+    attr.write = func(value []byte) uint8 {
+      if len(value) != 2 {
+        return 0x0D
+      }
+      cccd := uint16(value[0]) | uint16(value[1]) << 8
+      this.mu.Lock()
+      this.subscriptions[valueHandle] = cccd
+      handler := this.subscribeHandlers[valueHandle]
+      this.mu.Unlock()
+      if handler != nil {
+        handler(cccd)
+      }
+      return 0
+    }
+  }
+}
+
+// Returns the packet for a notification or indication of `value` at `handle`
+// and the connection to send it on, or a nil packet if the client isn't
+// subscribed to it with `bit`.
+func (this *VirtualDevice) valuePacket(opcode uint8, bit uint16, handle uint16,
+                                       value []byte) ([]byte, net.Conn,
+                                                     *attributeServer) {
+  this.mu.Lock()
+  conn, server := this.conn, this.server
+  cccd := this.subscriptions[handle]
+  this.mu.Unlock()
+  if conn == nil || cccd & bit == 0 {
+    return nil, nil, nil
+  }
+
+  pkt := append([]byte{opcode, byte(handle & 0xff), byte(handle >> 8)},
+    value...)
+  return FitToMTU(pkt, server.linkMTU()), conn, server
+}
+
+// Notifies the subscribed client, if any, of a new value of the characteristic
+// at `handle`.
+func (this *VirtualDevice) Notify(handle uint16, value []byte) error {
+  pkt, conn, _ := this.valuePacket(ATT_OPCODE_HANDLE_VALUE_NOTIFICATION,
+    GATT_CCCD_NOTIFY, handle, value)
+  if pkt == nil {
+    return nil
+  }
+  _, err := conn.Write(pkt)
+  return err
+}
+
+// Indicates a new value of the characteristic at `handle` to the subscribed
+// client, if any, waiting until it is confirmed.
+func (this *VirtualDevice) Indicate(handle uint16, value []byte) error {
+  pkt, conn, server := this.valuePacket(ATT_OPCODE_HANDLE_VALUE_INDICATION,
+    GATT_CCCD_INDICATE, handle, value)
+  if pkt == nil {
+    return nil
+  }
+
+  this.indicateMu.Lock()
+  defer this.indicateMu.Unlock()
+  // Discard a late confirmation of an earlier, timed out indication
+  select {
+  case <-server.confirmations:
+  default:
+  }
+  if _, err := conn.Write(pkt); err != nil {
+    return err
+  }
+  select {
+  case <-server.confirmations:
+    return nil
+  case <-time.After(ATT_TRANSACTION_TIMEOUT):
+    return ErrTransactionTimeout
+  }
+}
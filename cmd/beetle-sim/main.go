@@ -0,0 +1,210 @@
+package main
+
+import (
+  "../../ble"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "time"
+)
+
+// A simulated peripheral's GATT database, as read from a profile file
+type Profile struct {
+  Name     string
+  Services []ServiceProfile
+}
+
+type ServiceProfile struct {
+  // A 16-bit assigned number, e.g. "180D", or a 128-bit UUID in canonical form
+  UUID            string
+  Characteristics []CharacteristicProfile
+}
+
+type CharacteristicProfile struct {
+  UUID        string
+  // Any of "read", "write", "writeWithoutResponse", "notify" and "indicate"
+  Properties  []string
+  // Initial value in hex, or as text if Text is set instead
+  Value       string
+  Text        string
+  Descriptors []DescriptorProfile
+  Schedule    *ScheduleProfile
+}
+
+type DescriptorProfile struct {
+  UUID     string
+  Value    string
+  Text     string
+  Writable bool
+}
+
+// Values to cycle the characteristic through, notifying or indicating each one
+// to subscribers
+type ScheduleProfile struct {
+  Interval string
+  Values   []string
+}
+
+var PROPERTIES = map[string]uint8{
+  "read": ble.GATT_PROP_READ,
+  "writeWithoutResponse": ble.GATT_PROP_WRITE_NO_RESPONSE,
+  "write": ble.GATT_PROP_WRITE,
+  "notify": ble.GATT_PROP_NOTIFY,
+  "indicate": ble.GATT_PROP_INDICATE,
+}
+
+func parseValue(value string, text string) ([]byte, error) {
+  if text != "" {
+    return []byte(text), nil
+  }
+  return hex.DecodeString(value)
+}
+
+// A characteristic whose value changes on a schedule
+type scheduled struct {
+  handle   uint16
+  indicate bool
+  interval time.Duration
+  values   [][]byte
+}
+
+// Builds a virtual device from a profile, returning it along with the
+// characteristics to update on a schedule.
+func build(profile *Profile) (*ble.VirtualDevice, []*scheduled, error) {
+  vd := ble.NewVirtualDevice(profile.Name)
+  schedules := make([]*scheduled, 0)
+
+  for _, service := range profile.Services {
+    uuid, err := ble.ParseUUID(service.UUID)
+    if err != nil {
+      return nil, nil, err
+    }
+    vd.AddService(uuid)
+
+    for _, char := range service.Characteristics {
+      uuid, err := ble.ParseUUID(char.UUID)
+      if err != nil {
+        return nil, nil, err
+      }
+      props := uint8(0)
+      for _, name := range char.Properties {
+        prop, ok := PROPERTIES[name]
+        if !ok {
+          return nil, nil, errors.New("Unknown property " + name)
+        }
+        props |= prop
+      }
+      value, err := parseValue(char.Value, char.Text)
+      if err != nil {
+        return nil, nil, err
+      }
+      handle := vd.AddCharacteristic(uuid, props, value)
+
+      for _, desc := range char.Descriptors {
+        uuid, err := ble.ParseUUID(desc.UUID)
+        if err != nil {
+          return nil, nil, err
+        }
+        value, err := parseValue(desc.Value, desc.Text)
+        if err != nil {
+          return nil, nil, err
+        }
+        vd.AddDescriptor(uuid, value, desc.Writable)
+      }
+
+      if char.Schedule == nil {
+        continue
+      }
+      interval, err := time.ParseDuration(char.Schedule.Interval)
+      if err != nil {
+        return nil, nil, err
+      }
+      sched := &scheduled{handle, props & ble.GATT_PROP_NOTIFY == 0, interval,
+        make([][]byte, 0)}
+      for _, str := range char.Schedule.Values {
+        value, err := hex.DecodeString(str)
+        if err != nil {
+          return nil, nil, err
+        }
+        sched.values = append(sched.values, value)
+      }
+      if len(sched.values) > 0 {
+        schedules = append(schedules, sched)
+      }
+    }
+  }
+
+  return vd, schedules, nil
+}
+
+// Cycles a characteristic through its scheduled values forever.
+func run(vd *ble.VirtualDevice, sched *scheduled) {
+  for i := 0; ; i = (i + 1) % len(sched.values) {
+    time.Sleep(sched.interval)
+    value := sched.values[i]
+    vd.SetValue(sched.handle, value)
+    var err error
+    if sched.indicate {
+      err = vd.Indicate(sched.handle, value)
+    } else {
+      err = vd.Notify(sched.handle, value)
+    }
+    if err != nil {
+      fmt.Printf("ERROR: %s\n", err)
+    }
+  }
+}
+
+func main() {
+  addr := flag.String("listen", ":5555", "TCP address to accept Beetle on")
+  flag.Parse()
+  if flag.NArg() != 1 {
+    fmt.Printf("Usage: beetle-sim [-listen [IP]:PORT] PROFILE.json\n")
+    os.Exit(2)
+  }
+
+  buf, err := ioutil.ReadFile(flag.Arg(0))
+  if err != nil {
+    fmt.Printf("%s\n", err)
+    os.Exit(1)
+  }
+  var profile Profile
+  if err := json.Unmarshal(buf, &profile); err != nil {
+    fmt.Printf("%s: %s\n", flag.Arg(0), err)
+    os.Exit(1)
+  }
+  vd, schedules, err := build(&profile)
+  if err != nil {
+    fmt.Printf("%s: %s\n", flag.Arg(0), err)
+    os.Exit(1)
+  }
+
+  ln, err := net.Listen("tcp", *addr)
+  if err != nil {
+    fmt.Printf("%s\n", err)
+    os.Exit(1)
+  }
+  fmt.Printf("Simulating %s (%d handles) on %s\n", profile.Name,
+    vd.HighestHandle(), ln.Addr())
+
+  for _, sched := range schedules {
+    go run(vd, sched)
+  }
+
+  // Like a real peripheral, serve one central at a time
+  for {
+    conn, err := ln.Accept()
+    if err != nil {
+      fmt.Printf("ERROR: %s\n", err)
+      os.Exit(1)
+    }
+    fmt.Printf("Connected to %s\n", conn.RemoteAddr())
+    vd.Serve(ble.NewFramedConn(conn))
+    fmt.Printf("Disconnected from %s\n", conn.RemoteAddr())
+  }
+}
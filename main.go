@@ -5,7 +5,9 @@ import (
   "bufio"
   "fmt"
   "io"
+  "net"
   "os"
+  "path/filepath"
   "strconv"
   "strings"
 )
@@ -19,9 +21,15 @@ func main() {
   }
 
   manager := ble.NewManager(hciSock)
+  if dir, err := os.UserCacheDir(); err == nil {
+    manager.SetCacheDir(filepath.Join(dir, "beetle"))
+  }
 
   go manager.RunRouter()
 
+  // Listeners by the address or path they were started with
+  listeners := make(map[string]net.Listener)
+
   for {
     fmt.Printf("> ")
     lineBs, _, err := bio.ReadLine()
@@ -49,12 +57,8 @@ func main() {
         continue
       }
       interval := uint16(interval64)
-      for _,device := range(manager.Devices) {
-        res := manager.ConnUpdate(device, interval)
-        if res != 0 {
-          fmt.Printf("ERROR: %d\n", res)
-          break
-        }
+      if res := manager.SetInterval(interval); res != 0 {
+        fmt.Printf("ERROR: %d\n", res)
       }
     case "connect":
       if len(parts) < 3 {
@@ -100,6 +104,54 @@ func main() {
       } else {
         fmt.Printf("done\n")
       }
+    case "listen":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: listen [IP]:PORT\n")
+        continue
+      }
+      if listeners[parts[1]] != nil {
+        fmt.Printf("ERROR: already listening on %s\n", parts[1])
+        continue
+      }
+      fmt.Printf("Listening on %s... ", parts[1])
+      ln, err := manager.ListenTCP(parts[1])
+      if err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+      } else {
+        listeners[parts[1]] = ln
+        fmt.Printf("done\n")
+      }
+    case "listenUnix":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: listenUnix PATH\n")
+        continue
+      }
+      if listeners[parts[1]] != nil {
+        fmt.Printf("ERROR: already listening on %s\n", parts[1])
+        continue
+      }
+      fmt.Printf("Listening on %s... ", parts[1])
+      ln, err := manager.ListenUnix(parts[1])
+      if err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+      } else {
+        listeners[parts[1]] = ln
+        fmt.Printf("done\n")
+      }
+    case "unlisten":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: unlisten ADDRESS|PATH\n")
+        continue
+      }
+      ln := listeners[parts[1]]
+      if ln == nil {
+        fmt.Printf("ERROR: not listening on %s\n", parts[1])
+        continue
+      }
+      delete(listeners, parts[1])
+      if err := ln.Close(); err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+      }
     case "disconnect":
       if len(parts) < 2 {
         fmt.Printf("Usage: disconnect [device_address]\n")
@@ -144,24 +196,127 @@ func main() {
       } else {
         fmt.Printf("done\n")
       }
+    case "serve":
+      if len(parts) < 3 {
+        fmt.Printf("Usage: serve DEVICE_FROM DEVICE_TO\n")
+        continue
+      }
+      err = manager.Serve(parts[1], parts[2])
+      if err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+      }
+    case "unserve":
+      if len(parts) < 3 {
+        fmt.Printf("Usage: unserve DEVICE_FROM DEVICE_TO\n")
+        continue
+      }
+      err = manager.Unserve(parts[1], parts[2])
+      if err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+      }
     case "devices":
-      if len(manager.Devices) == 0 {
+      devices := manager.StrDevices()
+      if devices == "" {
         fmt.Printf("No connected devices\n")
       }
-      for nick,device := range(manager.Devices) {
-        fmt.Printf("%s:\t%s\n", nick, device)
-      }
+      fmt.Printf("%s", devices)
     case "handles":
       if len(parts) < 2 {
         fmt.Printf("Usage: handles [device_nick]\n")
         continue
       }
-      device, ok := manager.Devices[parts[1]]
-      if !ok {
+      handles, err := manager.StrHandles(parts[1])
+      if err != nil {
         fmt.Printf("Unknown device %s\n", parts[1])
         continue
       }
-      fmt.Printf("%s", device.StrHandles())
+      fmt.Printf("%s", handles)
+    case "ranges":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: ranges [device_nick]\n")
+        continue
+      }
+      ranges, err := manager.StrRanges(parts[1])
+      if err != nil {
+        fmt.Printf("Unknown device %s\n", parts[1])
+        continue
+      }
+      fmt.Printf("%s", ranges)
+    case "rediscover":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: rediscover [device_nick]\n")
+        continue
+      }
+      err := manager.Rediscover(parts[1])
+      if err != nil {
+        fmt.Printf("%s\n", err)
+      }
+    case "cache":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: cache DIR|off\n")
+        continue
+      }
+      if parts[1] == "off" {
+        manager.SetCacheDir("")
+      } else {
+        manager.SetCacheDir(parts[1])
+      }
+    case "name":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: name NAME\n")
+        continue
+      }
+      manager.SetName(strings.Join(parts[1:], " "))
+    case "confirm":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: confirm all|first\n")
+        continue
+      }
+      switch parts[1] {
+      case "all":
+        manager.SetConfirmPolicy(ble.CONFIRM_ALL)
+      case "first":
+        manager.SetConfirmPolicy(ble.CONFIRM_FIRST)
+      default:
+        fmt.Printf("Usage: confirm all|first\n")
+      }
+    case "policy":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: policy FILE|reload|off\n")
+        continue
+      }
+      switch parts[1] {
+      case "reload":
+        err = manager.ReloadPolicy()
+      case "off":
+        err = manager.SetPolicy(nil)
+      default:
+        err = manager.LoadPolicy(parts[1])
+      }
+      if err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+      }
+    case "audit":
+      if len(parts) < 2 {
+        fmt.Printf("Usage: audit FILE [values]|off\n")
+        continue
+      }
+      if parts[1] == "off" {
+        if err := manager.SetAuditLog(nil); err != nil {
+          fmt.Printf("ERROR: audit log: %s\n", err)
+        }
+        continue
+      }
+      values := len(parts) >= 3 && parts[2] == "values"
+      log, err := ble.OpenAuditLog(parts[1], ble.DEFAULT_AUDIT_MAX_SIZE,
+        ble.DEFAULT_AUDIT_KEEP, values)
+      if err != nil {
+        fmt.Printf("ERROR: %s\n", err)
+        continue
+      }
+      if err := manager.SetAuditLog(log); err != nil {
+        fmt.Printf("ERROR: audit log: %s\n", err)
+      }
     case "debug":
       if (len(parts) < 2) {
         fmt.Printf("Usage: debug on|off\n")